@@ -5,12 +5,19 @@ package avif
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"io"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Errors .
@@ -19,11 +26,13 @@ var (
 	ErrMemWrite = errors.New("avif: mem write failed")
 	ErrDecode   = errors.New("avif: decode failed")
 	ErrEncode   = errors.New("avif: encode failed")
+	// ErrTargetSize is returned by EncodeToSize when the image does not fit at any quality.
+	ErrTargetSize = errors.New("avif: target size not reached")
 )
 
 // AVIF represents the possibly multiple images stored in a AVIF file.
 type AVIF struct {
-	// Decoded images, NRGBA or NRGBA64.
+	// Decoded images, RGBA or RGBA64, NRGBA or NRGBA64 with Options.StraightAlpha, Gray or Gray16 for monochrome images.
 	Image []image.Image
 	// Delay times, one per frame, in seconds.
 	Delay []float64
@@ -35,52 +44,222 @@ const DefaultQuality = 60
 // DefaultSpeed is the default speed encoding parameter.
 const DefaultSpeed = 10
 
+// Chroma downsampling filters, see Options.ChromaDownsampling.
+const (
+	// ChromaDownsamplingAutomatic lets libavif pick, libyuv when available and averaging otherwise.
+	ChromaDownsamplingAutomatic = iota
+	// ChromaDownsamplingFastest prefers speed, the same as ChromaDownsamplingAutomatic.
+	ChromaDownsamplingFastest
+	// ChromaDownsamplingBestQuality avoids libyuv and averages.
+	ChromaDownsamplingBestQuality
+	// ChromaDownsamplingAverage averages the chroma of the covered pixels.
+	ChromaDownsamplingAverage
+	// ChromaDownsamplingSharpYUV uses libsharpyuv, slower but with sharper colored edges.
+	ChromaDownsamplingSharpYUV
+)
+
+// AV1 codecs, see Options.Codec. The values match libavif's avifCodecChoice.
+const (
+	// CodecAuto lets libavif pick the first available codec.
+	CodecAuto = iota
+	// CodecAOM is libaom, it can encode and decode.
+	CodecAOM
+	// CodecDav1d is the dav1d decoder.
+	CodecDav1d
+	// CodecLibgav1 is the libgav1 decoder.
+	CodecLibgav1
+	// CodecRav1e is the rav1e encoder.
+	CodecRav1e
+	// CodecSVT is the SVT-AV1 encoder.
+	CodecSVT
+)
+
+// codecNames are the libavif names of the codecs, indexed by codec.
+var codecNames = [...]string{"auto", "aom", "dav1d", "libgav1", "rav1e", "svt"}
+
+// DefaultTimescale is the default number of time units per second for animated images.
+const DefaultTimescale = 1000
+
+// DefaultDenoiseLevel is the noise level used for Options.FilmGrain without a DenoiseLevel.
+const DefaultDenoiseLevel = 25
+
 // Options are the encoding parameters.
 type Options struct {
 	// Quality in the range [0,100]. Default is 60.
 	Quality int
 	// Quality in the range [0,100].
 	QualityAlpha int
+	// MinQuantizer is the best color quantizer in the range [0,63]. Setting a color quantizer overrides Quality.
+	MinQuantizer int
+	// MaxQuantizer is the worst color quantizer in the range [0,63], 0 with MinQuantizer 0 uses Quality.
+	// Left at 0 with MinQuantizer set, it defaults to 63.
+	MaxQuantizer int
+	// MinQuantizerAlpha is the best alpha quantizer in the range [0,63]. Setting an alpha quantizer overrides QualityAlpha.
+	MinQuantizerAlpha int
+	// MaxQuantizerAlpha is the worst alpha quantizer in the range [0,63], 0 with MinQuantizerAlpha 0 uses QualityAlpha.
+	// Left at 0 with MinQuantizerAlpha set, it defaults to 63.
+	MaxQuantizerAlpha int
 	// Speed in the range [0,10]. Slower should make for a better quality image in less bytes.
 	Speed int
-	// Chroma subsampling, 444|422|420.
+	// Chroma subsampling, 444|422|420. YCbCr images keep their own subsampling, Gray and Gray16 are stored as 4:0:0.
 	ChromaSubsampling image.YCbCrSubsampleRatio
+	// ChromaDownsampling is the filter RGB sources are subsampled with for 4:2:0 and 4:2:2, e.g. ChromaDownsamplingAverage.
+	ChromaDownsampling int
+	// SharpYUV selects ChromaDownsamplingSharpYUV, which keeps colored edges such as red text on white sharp.
+	SharpYUV bool
 	// Lossless enables lossless compression. Lossless ignores quality and forces 4:4:4 chroma.
 	Lossless bool
+	// LosslessAlpha keeps the alpha plane bit-exact while the color stays lossy. It ignores QualityAlpha and the alpha quantizers.
+	LosslessAlpha bool
+	// DropOpaqueAlpha leaves out the alpha plane when every frame is fully opaque.
+	DropOpaqueAlpha bool
+	// Depth is the encoded bit depth, 8|10|12. Default picks 10 for 16-bit images (RGBA64, NRGBA64, Gray16) and 8 otherwise.
+	Depth int
+	// Color is the CICP color description written to the nclx box, nil keeps the libavif defaults.
+	// Y'CbCr, Gray and lossless sources keep their own matrix coefficients and range.
+	Color *CICP
+	// HDR is the HDR transfer, TransferCharacteristicsPQ or TransferCharacteristicsHLG. It writes BT.2020 primaries
+	// over Color and needs a depth of 10 or 12 (default 10). RGBA64/NRGBA64 sources hold the PQ/HLG code values,
+	// LinearRGBA sources are converted and need HDR set.
+	HDR int
+	// MaxCLL is the maximum content light level in cd/m², written to the clli box with MaxPALL.
+	MaxCLL int
+	// MaxPALL is the maximum picture average light level in cd/m².
+	MaxPALL int
+	// ICC is an ICC color profile stored with the image.
+	ICC []byte
+	// Exif is the Exif (TIFF) metadata stored with the image, with or without the "Exif\x00\x00" prefix.
+	Exif []byte
+	// XMP is the XMP packet stored with the image.
+	XMP []byte
+	// TileRows is the log2 of the number of tile rows, in the range [0,6].
+	TileRows int
+	// TileCols is the log2 of the number of tile columns, in the range [0,6].
+	TileCols int
+	// AutoTiling picks the tile rows and columns from the image size, ignoring TileRows and TileCols.
+	AutoTiling bool
+	// CodecOptions are codec specific key/value pairs passed to the AV1 encoder, e.g. "tune": "ssim".
+	// Keys may be prefixed with "color:" or "alpha:" to apply to one plane only.
+	CodecOptions map[string]string
+	// GridCols and GridRows split a still image into a grid of equal cells, each coded as its own AV1 frame.
+	// With both 0 a grid is picked automatically for images over the AV1 frame limits (16384x8704), padding the
+	// image by repeating its edges when it does not split evenly and cropping it back with a clean aperture that
+	// Decode and DecodeConfig apply.
+	GridCols int
+	// GridRows is the number of grid rows, see GridCols.
+	GridRows int
+	// TargetSSIM is the minimum mean SSIM of the luma in the range (0,1]. When set, still images are encoded at the
+	// lowest quality (smallest output) whose decoded result reaches it, searching from trial encodes. Quality is ignored.
+	TargetSSIM float64
+	// TargetPSNR is the minimum PSNR in dB over the premultiplied RGBA samples, see TargetSSIM. Both targets are met when set.
+	TargetPSNR float64
+	// CompactHeader writes the reduced mini header instead of the full meta box, saving a few hundred bytes on small
+	// images. libavif falls back to the full header for images the mini box cannot describe, e.g. grids and animations.
+	CompactHeader bool
+	// FilmGrain denoises the color planes before coding and stores the removed noise as AV1 film grain parameters,
+	// synthesized again on decode. Grainy photographic content codes much smaller. Ignored with Lossless.
+	FilmGrain bool
+	// DenoiseLevel is the aom noise level in the range [0,50], higher removes more grain. Setting it enables FilmGrain,
+	// the default is 25. A "denoise-noise-level" codec option takes precedence.
+	DenoiseLevel int
+	// Codec is the AV1 encoder or decoder used, CodecAuto by default. The codecs available depend on the loaded
+	// libavif, the WASM build has the aom encoder and the dav1d decoder only. An unavailable codec is an error.
+	Codec int
+	// IgnoreFilmGrain returns the decoded image without the film grain synthesized on top (Decode/DecodeAll only).
+	// The dynamic library exposes no such setting, these images are always decoded with the WASM module, and a Codec
+	// other than CodecAuto or CodecDav1d is an error.
+	IgnoreFilmGrain bool
+	// Scale codes the AV1 frame at a fraction of the image size, e.g. {1, 2}, and it is upscaled on decode.
+	// The zero value codes it at full size. Layers use their own scale.
+	Scale Fraction
+	// Layers writes a progressive image whose layers are decodable in turn, e.g. a small low quality preview first.
+	// Up to 4 layers are supported, for still images only. Layer qualities override Quality.
+	Layers []Layer
+	// Orientation is the EXIF orientation 1-8 stored as irot/imir properties, the pixels are not rotated.
+	// 0 leaves the transform unset, or as derived from the Exif metadata.
+	Orientation int
+	// PremultipliedAlpha stores the color premultiplied by alpha and flags it as such, RGBA sources only.
+	PremultipliedAlpha bool
+	// StraightAlpha returns NRGBA or NRGBA64 images with unassociated alpha instead of RGBA or RGBA64 (Decode/DecodeAll only).
+	// NRGBA and NRGBA64 sources are always encoded with unassociated alpha.
+	StraightAlpha bool
+	// Crop marks a clean aperture (clap) window in pixels from the top-left corner, e.g. to crop padding added for
+	// 4:2:0 subsampling. The image is stored in full; the zero value stores no window.
+	Crop image.Rectangle
+	// PixelAspect is the pixel aspect ratio written to the pasp box as horizontal/vertical spacing, zero writes none.
+	PixelAspect Fraction
+	// ApplyCrop returns the clean aperture window of the decoded image (Decode/DecodeAll only). It is applied before
+	// AutoRotate, the pixel aspect ratio is reported by DecodeMetadata. Grid images are always cropped, so a grid
+	// padded to equal cells decodes at its original size.
+	ApplyCrop bool
 	// AutoRotate applies the irot/imir orientation to the decoded image (Decode/DecodeAll only).
 	AutoRotate bool
+	// Stats, when set, is filled in with the statistics of the encode or decode.
+	Stats *Stats
+	// Timescale is the number of time units per second used for frame durations (EncodeAll only). Default is 1000.
+	Timescale int
+	// KeyframeInterval is the maximum distance between keyframes, 0 lets the encoder decide (EncodeAll only).
+	KeyframeInterval int
+	// LoopCount controls how many times the animation is restarted (EncodeAll only).
+	// 0 loops forever, -1 shows each frame only once, otherwise the animation is looped LoopCount+1 times.
+	LoopCount int
 }
 
-// avifMaxHeaderSize bounds the prefix read to find dimensions without decoding.
-const avifMaxHeaderSize = 1 << 18
+// Stats reports how an image was encoded or decoded, see Options.Stats.
+type Stats struct {
+	// Backend is the implementation that did the work, "dynamic", "wazero" or "wasm2go".
+	Backend string
+	// ColorSize is the size in bytes of the color AV1 OBUs.
+	ColorSize int
+	// AlphaSize is the size in bytes of the alpha AV1 OBUs, 0 without alpha.
+	AlphaSize int
+	// Frames is the number of frames encoded or decoded.
+	Frames int
+	// Convert is the time spent converting between RGB and YUV.
+	Convert time.Duration
+	// Codec is the time spent in the AV1 encoder or decoder, over all attempts with a target size or quality.
+	Codec time.Duration
+}
 
-func doDecode(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config, error) {
-	if dynamic {
-		return decodeDynamic(r, configOnly, decodeAll)
-	}
+// Layer is one layer of a progressive image, from the first (smallest) to the last.
+type Layer struct {
+	// Quality of the color planes in the range [0,100]. Default is 60.
+	Quality int
+	// Scale is the fraction of the full size the layer is coded at, the zero value codes it at full size.
+	Scale Fraction
+}
 
-	return decode(r, configOnly, decodeAll)
+// Fraction is the ratio N/D.
+type Fraction struct {
+	N, D int
 }
 
-// Decode reads a AVIF image from r; pass Options{AutoRotate: true} to apply the orientation.
-func Decode(r io.Reader, opts ...Options) (image.Image, error) {
-	if len(opts) > 0 && opts[0].AutoRotate {
-		data, err := io.ReadAll(r)
-		if err != nil {
-			return nil, fmt.Errorf("avif: read: %w", err)
-		}
+// maxLayers is the most layers libavif writes (AVIF_MAX_AV1_LAYER_COUNT).
+const maxLayers = 4
 
-		ret, _, err := doDecode(bytes.NewReader(data), false, false)
-		if err != nil {
-			return nil, err
-		}
+// avifMaxHeaderSize bounds the prefix read to find dimensions without decoding.
+const avifMaxHeaderSize = 1 << 18
 
-		props, _ := parseAVIFProps(data)
+func doDecode(r io.Reader, configOnly, decodeAll bool, o Options) (*AVIF, image.Config, error) {
+	if dynamic && !o.IgnoreFilmGrain {
+		return decodeDynamic(r, configOnly, decodeAll, o)
+	}
 
-		return applyOrientation(ret.Image[0], props.orientation), nil
+	if dynamic && o.Codec != CodecAuto && o.Codec != CodecDav1d {
+		return nil, image.Config{}, errors.New("avif: IgnoreFilmGrain decodes with the WASM module, which supports only the dav1d codec")
 	}
 
-	ret, _, err := doDecode(r, false, false)
+	if err := checkCodec(o.Codec, false); err != nil {
+		return nil, image.Config{}, err
+	}
+
+	return decode(r, configOnly, decodeAll, o)
+}
+
+// Decode reads a AVIF image from r; pass Options{AutoRotate: true} to apply the orientation,
+// Options{StraightAlpha: true} for NRGBA or NRGBA64.
+func Decode(r io.Reader, opts ...Options) (image.Image, error) {
+	ret, err := decodeImages(r, false, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -96,15 +275,15 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 	}
 
 	if props, ok := parseAVIFProps(prefix); ok {
-		cm := color.RGBAModel
-		if props.hiDepth {
-			cm = color.RGBA64Model
+		width, height := props.width, props.height
+		if props.grid && !props.crop.Empty() {
+			width, height = props.crop.Dx(), props.crop.Dy()
 		}
 
-		return image.Config{ColorModel: cm, Width: props.width, Height: props.height}, nil
+		return image.Config{ColorModel: props.colorModel(), Width: width, Height: height}, nil
 	}
 
-	_, cfg, err := doDecode(io.MultiReader(bytes.NewReader(prefix), r), true, false)
+	_, cfg, err := doDecode(io.MultiReader(bytes.NewReader(prefix), r), true, false, Options{})
 	if err != nil {
 		return image.Config{}, err
 	}
@@ -112,93 +291,501 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 	return cfg, nil
 }
 
-// DecodeAll reads a AVIF image from r; pass Options{AutoRotate: true} to orient each frame.
+// DecodeAll reads a AVIF image from r; pass Options{AutoRotate: true} to orient each frame,
+// Options{StraightAlpha: true} for NRGBA or NRGBA64.
 func DecodeAll(r io.Reader, opts ...Options) (*AVIF, error) {
-	if len(opts) > 0 && opts[0].AutoRotate {
-		data, err := io.ReadAll(r)
-		if err != nil {
-			return nil, fmt.Errorf("avif: read: %w", err)
+	return decodeImages(r, true, opts)
+}
+
+// decodeImages decodes the first or all frames from r, returning monochrome images as Gray/Gray16
+// and applying the orientation when asked to.
+func decodeImages(r io.Reader, decodeAll bool, opts []Options) (*AVIF, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("avif: read: %w", err)
+	}
+
+	var o Options
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+
+	ret, cfg, err := doDecode(bytes.NewReader(data), false, decodeAll, o)
+	if err != nil {
+		return nil, err
+	}
+
+	props, _ := parseAVIFProps(data)
+	gray := props.monochrome && !props.alpha || cfg.ColorModel == color.GrayModel || cfg.ColorModel == color.Gray16Model
+
+	for i, img := range ret.Image {
+		if gray {
+			img = imageToGray(img)
+		}
+
+		if (o.ApplyCrop || props.grid) && !props.crop.Empty() {
+			img = cropImage(img, props.crop)
+		}
+
+		if o.AutoRotate {
+			img = applyOrientation(img, props.orientation)
 		}
 
-		ret, _, err := doDecode(bytes.NewReader(data), false, true)
+		ret.Image[i] = img
+	}
+
+	return ret, nil
+}
+
+// Encode writes the image m to w with the given options.
+func Encode(w io.Writer, m image.Image, o ...Options) error {
+	return doEncode(w, []image.Image{m}, []uint64{1}, encodeOptions(o))
+}
+
+// EncodeAll writes the images in a to w as an animated AVIF (image sequence) with the given options.
+func EncodeAll(w io.Writer, a *AVIF, o ...Options) error {
+	if a == nil || len(a.Image) == 0 {
+		return errors.New("avif: no images")
+	}
+
+	if len(a.Image) != len(a.Delay) {
+		return errors.New("avif: mismatched image and delay lengths")
+	}
+
+	b := a.Image[0].Bounds()
+	for i, m := range a.Image[1:] {
+		if m.Bounds().Dx() != b.Dx() || m.Bounds().Dy() != b.Dy() {
+			return fmt.Errorf("avif: frame %d is %dx%d, want %dx%d", i+1, m.Bounds().Dx(), m.Bounds().Dy(), b.Dx(), b.Dy())
+		}
+	}
+
+	opt := encodeOptions(o)
+
+	return doEncode(w, a.Image, frameDurations(a.Delay, opt.Timescale), opt)
+}
+
+// EncodeToSize writes the image m to w at the highest quality whose output fits in maxBytes and returns that quality.
+// The image is converted to YUV once and only re-encoded between attempts. Quality is ignored and Layers are not supported.
+func EncodeToSize(w io.Writer, m image.Image, maxBytes int, o ...Options) (int, error) {
+	if maxBytes <= 0 {
+		return 0, fmt.Errorf("avif: invalid target size %d", maxBytes)
+	}
+
+	opt := encodeOptions(o)
+	if len(opt.Layers) > 0 {
+		return 0, errors.New("avif: layers are not supported with a target size")
+	}
+
+	if opt.TargetSSIM > 0 || opt.TargetPSNR > 0 {
+		return 0, errors.New("avif: target quality is not supported with a target size")
+	}
+
+	if err := checkOptions(opt); err != nil {
+		return 0, err
+	}
+
+	if dynamic {
+		return encodeDynamicToSize(w, []image.Image{m}, []uint64{1}, opt, maxBytes)
+	}
+
+	if err := checkCodec(opt.Codec, true); err != nil {
+		return 0, err
+	}
+
+	return encodeToSize(w, []image.Image{m}, []uint64{1}, opt, maxBytes)
+}
+
+func doEncode(w io.Writer, images []image.Image, durations []uint64, o Options) error {
+	if err := checkOptions(o); err != nil {
+		return err
+	}
+
+	if len(o.Layers) > 0 && len(images) > 1 {
+		return errors.New("avif: layers are not supported for animations")
+	}
+
+	if (o.TargetSSIM > 0 || o.TargetPSNR > 0) && !o.Lossless {
+		return encodeToQuality(w, images, o)
+	}
+
+	return encodeImages(w, images, durations, o)
+}
+
+func encodeImages(w io.Writer, images []image.Image, durations []uint64, o Options) error {
+	if dynamic {
+		return encodeDynamic(w, images, durations, o)
+	}
+
+	if err := checkCodec(o.Codec, true); err != nil {
+		return err
+	}
+
+	return encode(w, images, durations, o)
+}
+
+// checkCodec reports a codec the WASM build cannot encode or decode with, it has the aom encoder and the dav1d decoder.
+func checkCodec(codec int, encode bool) error {
+	if codec == CodecAuto || (encode && codec == CodecAOM) || (!encode && codec == CodecDav1d) {
+		return nil
+	}
+
+	return codecError(codec, encode, "the WASM build (aom [enc], dav1d [dec])")
+}
+
+// wasmStatsSize is the number of uint64 statistics the WASM module writes: the color and alpha OBU sizes,
+// and the conversion and coding times in nanoseconds.
+const wasmStatsSize = 4
+
+// wasmStats returns the statistics written by the WASM module.
+func wasmStats(backend string, frames int, v [wasmStatsSize]uint64) Stats {
+	return Stats{
+		Backend:   backend,
+		ColorSize: int(v[0]),
+		AlphaSize: int(v[1]),
+		Frames:    frames,
+		Convert:   time.Duration(v[2]),
+		Codec:     time.Duration(v[3]),
+	}
+}
+
+// codecError returns the error for a codec missing from lib.
+func codecError(codec int, encode bool, lib string) error {
+	if codec < CodecAuto || codec >= len(codecNames) {
+		return fmt.Errorf("avif: unknown codec %d", codec)
+	}
+
+	op := "decode"
+	if encode {
+		op = "encode"
+	}
+
+	return fmt.Errorf("avif: codec %s cannot %s with %s", codecNames[codec], op, lib)
+}
+
+// encodeToQuality binary searches the quality of a still image for the smallest output whose decoded
+// result meets the target SSIM and PSNR. When no quality reaches the targets the quality 100 output is written.
+func encodeToQuality(w io.Writer, images []image.Image, o Options) error {
+	if len(images) > 1 {
+		return errors.New("avif: target quality is not supported for animations")
+	}
+
+	if len(o.Layers) > 0 {
+		return errors.New("avif: layers are not supported with a target quality")
+	}
+
+	if o.HDR != 0 {
+		return errors.New("avif: target quality is not supported for HDR")
+	}
+
+	src := newMetricPlanes(images[0])
+
+	stats := o.Stats
+	var total, attempt, bestStats, topStats Stats
+	o.Stats = &attempt
+
+	var best, top []byte
+	lo, hi := 0, 100
+
+	for lo <= hi {
+		q := (lo + hi) / 2
+		o.Quality = q
+
+		var b bytes.Buffer
+		if err := encodeImages(&b, images, []uint64{1}, o); err != nil {
+			return err
+		}
+
+		total.Convert += attempt.Convert
+		total.Codec += attempt.Codec
+
+		ret, err := decodeImages(bytes.NewReader(b.Bytes()), false, []Options{{ApplyCrop: true}})
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		props, _ := parseAVIFProps(data)
-		if props.orientation > 1 {
-			for i := range ret.Image {
-				ret.Image[i] = applyOrientation(ret.Image[i], props.orientation)
+		dst := newMetricPlanes(ret.Image[0])
+		if dst.width != src.width || dst.height != src.height {
+			return fmt.Errorf("avif: target quality decoded %dx%d from a %dx%d image", dst.width, dst.height, src.width, src.height)
+		}
+
+		if (o.TargetSSIM == 0 || src.ssim(dst) >= o.TargetSSIM) && (o.TargetPSNR == 0 || src.psnr(dst) >= o.TargetPSNR) {
+			best, bestStats = b.Bytes(), attempt
+			hi = q - 1
+		} else {
+			if q == 100 {
+				top, topStats = b.Bytes(), attempt
 			}
+			lo = q + 1
 		}
+	}
+
+	if best == nil {
+		best, bestStats = top, topStats
+	}
 
-		return ret, nil
+	if stats != nil {
+		*stats = bestStats
+		stats.Convert, stats.Codec = total.Convert, total.Codec
 	}
 
-	ret, _, err := doDecode(r, false, true)
+	_, err := w.Write(best)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("avif: write: %w", err)
 	}
 
-	return ret, nil
+	return nil
 }
 
-// Encode writes the image m to w with the given options.
-func Encode(w io.Writer, m image.Image, o ...Options) error {
-	quality := DefaultQuality
-	qualityAlpha := DefaultQuality
-	speed := DefaultSpeed
-	chroma := image.YCbCrSubsampleRatio420
-	lossless := false
+// encodeOptions returns the first of o with defaults and limits applied.
+func encodeOptions(o []Options) Options {
+	opt := Options{
+		Quality:           DefaultQuality,
+		QualityAlpha:      DefaultQuality,
+		Speed:             DefaultSpeed,
+		ChromaSubsampling: image.YCbCrSubsampleRatio420,
+		Timescale:         DefaultTimescale,
+	}
 
 	if o != nil {
-		opt := o[0]
-		quality = opt.Quality
-		qualityAlpha = opt.QualityAlpha
-		speed = opt.Speed
-		chroma = opt.ChromaSubsampling
-		lossless = opt.Lossless
+		opt = o[0]
+
+		if opt.Quality <= 0 {
+			opt.Quality = DefaultQuality
+		} else if opt.Quality > 100 {
+			opt.Quality = 100
+		}
+
+		if opt.QualityAlpha <= 0 {
+			opt.QualityAlpha = DefaultQuality
+		} else if opt.QualityAlpha > 100 {
+			opt.QualityAlpha = 100
+		}
 
-		if quality <= 0 {
-			quality = DefaultQuality
-		} else if quality > 100 {
-			quality = 100
+		if opt.Speed < 0 {
+			opt.Speed = DefaultSpeed
+		} else if opt.Speed > 10 {
+			opt.Speed = 10
 		}
 
-		if qualityAlpha <= 0 {
-			qualityAlpha = DefaultQuality
-		} else if qualityAlpha > 100 {
-			qualityAlpha = 100
+		if opt.Timescale <= 0 {
+			opt.Timescale = DefaultTimescale
 		}
 
-		if speed < 0 {
-			speed = DefaultSpeed
-		} else if speed > 10 {
-			speed = 10
+		if opt.KeyframeInterval < 0 {
+			opt.KeyframeInterval = 0
+		}
+
+		opt.TileRows = min(max(opt.TileRows, 0), 6)
+		opt.TileCols = min(max(opt.TileCols, 0), 6)
+
+		if opt.Orientation < 0 || opt.Orientation > 8 {
+			opt.Orientation = 0
+		}
+
+		opt.MaxCLL = min(max(opt.MaxCLL, 0), math.MaxUint16)
+		opt.MaxPALL = min(max(opt.MaxPALL, 0), math.MaxUint16)
+
+		if opt.Layers != nil {
+			opt.Layers = slices.Clone(opt.Layers)
+			for i, l := range opt.Layers {
+				if l.Quality <= 0 {
+					opt.Layers[i].Quality = DefaultQuality
+				} else if l.Quality > 100 {
+					opt.Layers[i].Quality = 100
+				}
+
+				if l.Scale.D == 0 {
+					opt.Layers[i].Scale = Fraction{1, 1}
+				}
+			}
+		}
+
+		if opt.HDR != 0 {
+			c := CICP{MatrixCoefficients: MatrixCoefficientsBT2020NCL, FullRange: true}
+			if opt.Color != nil {
+				c = *opt.Color
+			}
+
+			c.ColorPrimaries = ColorPrimariesBT2020
+			c.TransferCharacteristics = opt.HDR
+			opt.Color = &c
 		}
 	}
 
-	if lossless {
-		quality = 100
-		qualityAlpha = 100
-		chroma = image.YCbCrSubsampleRatio444
+	if opt.Lossless {
+		opt.Quality = 100
+		opt.QualityAlpha = 100
+		opt.MinQuantizer, opt.MaxQuantizer = 0, 0
+		opt.MinQuantizerAlpha, opt.MaxQuantizerAlpha = 0, 0
+		opt.ChromaSubsampling = image.YCbCrSubsampleRatio444
+		opt.FilmGrain, opt.DenoiseLevel = false, 0
 	}
 
-	if dynamic {
-		err := encodeDynamic(w, m, quality, qualityAlpha, speed, chroma, lossless)
-		if err != nil {
-			return err
+	if opt.FilmGrain || opt.DenoiseLevel > 0 {
+		opt.CodecOptions = grainOptions(opt.CodecOptions, opt.DenoiseLevel)
+	}
+
+	if opt.Scale.D == 0 {
+		opt.Scale = Fraction{1, 1}
+	}
+
+	if opt.SharpYUV {
+		opt.ChromaDownsampling = ChromaDownsamplingSharpYUV
+	}
+
+	if opt.LosslessAlpha {
+		opt.QualityAlpha = 100
+		opt.MinQuantizerAlpha, opt.MaxQuantizerAlpha = 0, 0
+	}
+
+	if opt.MinQuantizer != 0 || opt.MaxQuantizer != 0 {
+		opt.Quality = avifQualityDefault
+	}
+
+	if opt.MaxQuantizer == 0 {
+		opt.MaxQuantizer = avifQuantizerWorstQuality
+	}
+
+	if opt.MinQuantizerAlpha != 0 || opt.MaxQuantizerAlpha != 0 {
+		opt.QualityAlpha = avifQualityDefault
+	}
+
+	if opt.MaxQuantizerAlpha == 0 {
+		opt.MaxQuantizerAlpha = avifQuantizerWorstQuality
+	}
+
+	return opt
+}
+
+// checkOptions reports a quantizer range outside [0,63] or with the minimum above the maximum,
+// a target SSIM outside [0,1] or a negative target PSNR, an unknown chroma downsampling filter,
+// an invalid pixel aspect ratio, too many layers or a scale outside (0,1], and codec options that cannot be passed as C strings.
+func checkOptions(o Options) error {
+	for _, q := range [][2]int{{o.MinQuantizer, o.MaxQuantizer}, {o.MinQuantizerAlpha, o.MaxQuantizerAlpha}} {
+		if q[0] < 0 || q[1] > avifQuantizerWorstQuality || q[0] > q[1] {
+			return fmt.Errorf("avif: invalid quantizer range [%d,%d]", q[0], q[1])
 		}
-	} else {
-		err := encode(w, m, quality, qualityAlpha, speed, chroma, lossless)
-		if err != nil {
-			return err
+	}
+
+	if o.TargetSSIM < 0 || o.TargetSSIM > 1 || o.TargetPSNR < 0 {
+		return fmt.Errorf("avif: invalid target SSIM %g or PSNR %g", o.TargetSSIM, o.TargetPSNR)
+	}
+
+	if o.ChromaDownsampling < ChromaDownsamplingAutomatic || o.ChromaDownsampling > ChromaDownsamplingSharpYUV {
+		return fmt.Errorf("avif: invalid chroma downsampling %d", o.ChromaDownsampling)
+	}
+
+	if (o.PixelAspect.N != 0 || o.PixelAspect.D != 0) && (o.PixelAspect.N <= 0 || o.PixelAspect.D <= 0) {
+		return fmt.Errorf("avif: invalid pixel aspect ratio %d/%d", o.PixelAspect.N, o.PixelAspect.D)
+	}
+
+	if len(o.Layers) > maxLayers {
+		return fmt.Errorf("avif: %d layers, at most %d are supported", len(o.Layers), maxLayers)
+	}
+
+	for _, l := range o.Layers {
+		if l.Scale.N <= 0 || l.Scale.N > l.Scale.D {
+			return fmt.Errorf("avif: invalid layer scale %d/%d", l.Scale.N, l.Scale.D)
+		}
+	}
+
+	if o.Scale.N <= 0 || o.Scale.N > o.Scale.D {
+		return fmt.Errorf("avif: invalid scale %d/%d", o.Scale.N, o.Scale.D)
+	}
+
+	for k, v := range o.CodecOptions {
+		if k == "" || strings.ContainsRune(k, 0) || strings.ContainsRune(v, 0) {
+			return fmt.Errorf("avif: invalid codec option %q", k)
 		}
 	}
 
 	return nil
 }
 
+// grainOptions returns a copy of the codec options enabling the aom denoiser and film grain table for the color
+// planes at the noise level, clamped to [1,50] with 0 picking DefaultDenoiseLevel. Explicit options are kept.
+func grainOptions(m map[string]string, level int) map[string]string {
+	if level <= 0 {
+		level = DefaultDenoiseLevel
+	}
+
+	opts := maps.Clone(m)
+	if opts == nil {
+		opts = make(map[string]string, 1)
+	}
+
+	_, ok := opts["denoise-noise-level"]
+	if _, colorOk := opts["color:denoise-noise-level"]; !ok && !colorOk {
+		opts["color:denoise-noise-level"] = strconv.Itoa(min(level, 50))
+	}
+
+	return opts
+}
+
+// codecOptions packs the codec options as NUL-terminated key/value pairs, sorted by key.
+func codecOptions(m map[string]string) []byte {
+	var b []byte
+	for _, k := range slices.Sorted(maps.Keys(m)) {
+		b = append(b, k...)
+		b = append(b, 0)
+		b = append(b, m[k]...)
+		b = append(b, 0)
+	}
+
+	return b
+}
+
+// layerParams packs the quality and scale of each layer as little-endian int32 triples.
+func layerParams(layers []Layer) []byte {
+	var b []byte
+	for _, l := range layers {
+		b = binary.LittleEndian.AppendUint32(b, uint32(l.Quality))
+		b = binary.LittleEndian.AppendUint32(b, uint32(l.Scale.N))
+		b = binary.LittleEndian.AppendUint32(b, uint32(l.Scale.D))
+	}
+
+	return b
+}
+
+// encodeError wraps ErrEncode with the libavif diagnostics in diag, a NUL-terminated string.
+func encodeError(diag []byte) error {
+	if i := bytes.IndexByte(diag, 0); i != -1 {
+		diag = diag[:i]
+	}
+
+	msg := strings.TrimSpace(string(diag))
+	if msg == "" {
+		return ErrEncode
+	}
+
+	return fmt.Errorf("%w: %s", ErrEncode, msg)
+}
+
+// frameDurations converts delays in seconds to durations in timescale units, at least one unit per frame.
+func frameDurations(delay []float64, timescale int) []uint64 {
+	durations := make([]uint64, len(delay))
+	for i, d := range delay {
+		durations[i] = 1
+		if v := math.Round(d * float64(timescale)); v > 1 {
+			durations[i] = uint64(v)
+		}
+	}
+
+	return durations
+}
+
+// repetitionCount maps an image/gif style loop count to the libavif repetition count.
+func repetitionCount(loopCount int) int {
+	switch {
+	case loopCount == 0:
+		return avifRepetitionCountInfinite
+	case loopCount < 0:
+		return 0
+	default:
+		return loopCount
+	}
+}
+
 // Dynamic returns error (if there was any) during opening dynamic/shared library.
 func Dynamic() error {
 	return dynamicErr
@@ -210,15 +797,38 @@ const (
 	avifPixelFormatYuv444 = 1
 	avifPixelFormatYuv422 = 2
 	avifPixelFormatYuv420 = 3
+	avifPixelFormatYuv400 = 4
+
+	avifPlanesYuv = 1
+	avifPlanesAll = 0xff
 
+	avifAddImageFlagNone   = 0
 	avifAddImageFlagSingle = 2
 
-	avifMatrixCoefficientsIdentity = 0
-	avifRangeFull                  = 1
+	avifRepetitionCountInfinite = -1
+
+	avifDiagnosticsErrorBufferSize = 256
+
+	avifQualityDefault        = -1
+	avifQuantizerWorstQuality = 63
+
+	avifTransformPasp = 1 << 0
+	avifTransformClap = 1 << 1
+	avifTransformIrot = 1 << 2
+	avifTransformImir = 1 << 3
+
+	avifCodecFlagCanDecode = 1 << 0
+	avifCodecFlagCanEncode = 1 << 1
+
+	avifRangeLimited = 0
+	avifRangeFull    = 1
+
+	avifHeaderDefault = 0
+	avifHeaderMini    = 1
 )
 
 func imageToRGBA(src image.Image) *image.RGBA {
-	if dst, ok := src.(*image.RGBA); ok {
+	if dst, ok := src.(*image.RGBA); ok && dst.Stride == dst.Rect.Dx()*4 {
 		return dst
 	}
 
@@ -229,6 +839,75 @@ func imageToRGBA(src image.Image) *image.RGBA {
 	return dst
 }
 
+// newImage wraps decoded pixels, RGBA64 or NRGBA64 samples when hiDepth is set, with unassociated alpha when straight is set.
+func newImage(pix []byte, width, height int, hiDepth, straight bool) image.Image {
+	r := image.Rect(0, 0, width, height)
+
+	switch {
+	case hiDepth && straight:
+		return &image.NRGBA64{Pix: pix, Stride: width * 8, Rect: r}
+	case hiDepth:
+		return &image.RGBA64{Pix: pix, Stride: width * 8, Rect: r}
+	case straight:
+		return &image.NRGBA{Pix: pix, Stride: width * 4, Rect: r}
+	}
+
+	return &image.RGBA{Pix: pix, Stride: width * 4, Rect: r}
+}
+
+// colorModel returns the color model of decoded images, see newImage; gray is set for monochrome images without
+// alpha, which decodeImages returns as Gray or Gray16.
+func colorModel(hiDepth, gray, straight bool) color.Model {
+	switch {
+	case gray && hiDepth:
+		return color.Gray16Model
+	case gray:
+		return color.GrayModel
+	case hiDepth && straight:
+		return color.NRGBA64Model
+	case hiDepth:
+		return color.RGBA64Model
+	case straight:
+		return color.NRGBAModel
+	}
+
+	return color.RGBAModel
+}
+
+// imageToGray returns the luma of a decoded monochrome image, which libavif expands to equal R, G and B.
+func imageToGray(img image.Image) image.Image {
+	switch src := img.(type) {
+	case *image.RGBA:
+		return grayPix(src.Pix, src.Rect)
+	case *image.NRGBA:
+		return grayPix(src.Pix, src.Rect)
+	case *image.RGBA64:
+		return gray16Pix(src.Pix, src.Rect)
+	case *image.NRGBA64:
+		return gray16Pix(src.Pix, src.Rect)
+	}
+
+	return img
+}
+
+func grayPix(pix []byte, r image.Rectangle) *image.Gray {
+	dst := image.NewGray(r)
+	for i := range dst.Pix {
+		dst.Pix[i] = pix[i*4]
+	}
+
+	return dst
+}
+
+func gray16Pix(pix []byte, r image.Rectangle) *image.Gray16 {
+	dst := image.NewGray16(r)
+	for i := 0; i < len(dst.Pix); i += 2 {
+		dst.Pix[i], dst.Pix[i+1] = pix[i*4], pix[i*4+1]
+	}
+
+	return dst
+}
+
 func decodeWrapper(r io.Reader) (image.Image, error) {
 	return Decode(r)
 }
@@ -236,4 +915,5 @@ func decodeWrapper(r io.Reader) (image.Image, error) {
 func init() {
 	image.RegisterFormat("avif", "????ftypavif", decodeWrapper, DecodeConfig)
 	image.RegisterFormat("avif", "????ftypavis", decodeWrapper, DecodeConfig)
+	image.RegisterFormat("avif", "????ftypmif3avif", decodeWrapper, DecodeConfig)
 }
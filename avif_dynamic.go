@@ -7,26 +7,33 @@ import (
 	"encoding/binary"
 	"fmt"
 	"image"
-	"image/color"
 	"io"
+	"maps"
 	"runtime"
+	"slices"
 	"strings"
+	"time"
 	"unsafe"
 
 	"github.com/ebitengine/purego"
 )
 
-func decodeDynamic(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config, error) {
+func decodeDynamic(r io.Reader, configOnly, decodeAll bool, o Options) (*AVIF, image.Config, error) {
 	var err error
 	var cfg image.Config
 	var data []byte
 
+	if err = checkDynamicCodec(o.Codec, avifCodecFlagCanDecode); err != nil {
+		return nil, cfg, err
+	}
+
 	data, err = io.ReadAll(r)
 	if err != nil {
 		return nil, cfg, fmt.Errorf("read: %w", err)
 	}
 
 	decoder := avifDecoderCreate()
+	decoder.CodecChoice = uint32(o.Codec)
 	decoder.IgnoreExif = 1
 	decoder.IgnoreXMP = 1
 	decoder.MaxThreads = int32(runtime.NumCPU())
@@ -38,17 +45,20 @@ func decodeDynamic(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config
 		return nil, cfg, fmt.Errorf("%w: %s", ErrDecode, toStr(decoder.Diag))
 	}
 
+	stats := Stats{Backend: "dynamic"}
+	start := time.Now()
+
 	if !avifDecoderParse(decoder) {
 		return nil, cfg, fmt.Errorf("%w: %s", ErrDecode, toStr(decoder.Diag))
 	}
 
+	stats.Codec += time.Since(start)
+
 	cfg.Width = int(decoder.Image.Width)
 	cfg.Height = int(decoder.Image.Height)
 
-	cfg.ColorModel = color.RGBAModel
-	if decoder.Image.Depth > 8 {
-		cfg.ColorModel = color.RGBA64Model
-	}
+	gray := decoder.Image.YuvFormat == avifPixelFormatYuv400 && decoder.AlphaPresent == 0
+	cfg.ColorModel = colorModel(decoder.Image.Depth > 8, gray, o.StraightAlpha)
 
 	if configOnly {
 		return nil, cfg, nil
@@ -61,7 +71,9 @@ func decodeDynamic(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config
 	avifRGBImageSetDefaults(&rgb, decoder.Image)
 
 	rgb.MaxThreads = int32(runtime.NumCPU())
-	rgb.AlphaPremultiplied = 1
+	if !o.StraightAlpha {
+		rgb.AlphaPremultiplied = 1
+	}
 
 	if decoder.Image.Depth > 8 {
 		rgb.Depth = 16
@@ -71,16 +83,24 @@ func decodeDynamic(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config
 		rgb.ChromaUpsampling = avifChromaUpsamplingFastest
 	}
 
-	for avifDecoderNextImage(decoder) {
+	for {
+		start = time.Now()
+		if !avifDecoderNextImage(decoder) {
+			break
+		}
+		stats.Codec += time.Since(start)
+
 		if !avifRGBImageAllocatePixels(&rgb) {
 			return nil, cfg, ErrDecode
 		}
 
+		start = time.Now()
 		if !avifImageYUVToRGB(decoder.Image, &rgb) {
 			avifRGBImageFreePixels(&rgb)
 
 			return nil, cfg, ErrDecode
 		}
+		stats.Convert += time.Since(start)
 
 		size := int(rgb.RowBytes) * cfg.Height
 
@@ -93,13 +113,9 @@ func decodeDynamic(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config
 				return nil, cfg, nil
 			}
 
-			img := image.NewRGBA64(image.Rect(0, 0, cfg.Width, cfg.Height))
-			img.Pix = b.Bytes()
-			images = append(images, img)
+			images = append(images, newImage(b.Bytes(), cfg.Width, cfg.Height, true, o.StraightAlpha))
 		} else {
-			img := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
-			copy(img.Pix, unsafe.Slice(rgb.Pixels, size))
-			images = append(images, img)
+			images = append(images, newImage(bytes.Clone(unsafe.Slice(rgb.Pixels, size)), cfg.Width, cfg.Height, false, o.StraightAlpha))
 		}
 
 		avifRGBImageFreePixels(&rgb)
@@ -113,6 +129,13 @@ func decodeDynamic(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config
 
 	runtime.KeepAlive(data)
 
+	if o.Stats != nil {
+		stats.ColorSize = int(decoder.IoStats.ColorOBUSize)
+		stats.AlphaSize = int(decoder.IoStats.AlphaOBUSize)
+		stats.Frames = len(images)
+		*o.Stats = stats
+	}
+
 	av := &AVIF{
 		Image: images,
 		Delay: delay,
@@ -121,71 +144,314 @@ func decodeDynamic(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config
 	return av, cfg, nil
 }
 
-func encodeDynamic(w io.Writer, m image.Image, quality, qualityAlpha, speed int, subsampleRatio image.YCbCrSubsampleRatio, lossless bool) error {
-	i := imageToRGBA(m)
+func encodeDynamic(w io.Writer, images []image.Image, durations []uint64, o Options) error {
+	_, err := encodeDynamicToSize(w, images, durations, o, 0)
 
-	var chroma int
-	switch subsampleRatio {
-	case image.YCbCrSubsampleRatio444:
-		chroma = avifPixelFormatYuv444
-	case image.YCbCrSubsampleRatio422:
-		chroma = avifPixelFormatYuv422
-	case image.YCbCrSubsampleRatio420:
-		chroma = avifPixelFormatYuv420
-	default:
-		return fmt.Errorf("unsupported chroma %d", subsampleRatio)
+	return err
+}
+
+func encodeDynamicToSize(w io.Writer, images []image.Image, durations []uint64, o Options, maxBytes int) (int, error) {
+	if err := checkDynamicCodec(o.Codec, avifCodecFlagCanEncode); err != nil {
+		return 0, err
+	}
+
+	in, err := newEncodeInput(images, o)
+	if err != nil {
+		return 0, err
 	}
 
-	img := avifImageCreate(i.Bounds().Dx(), i.Bounds().Dy(), 8, chroma)
+	img := avifImageCreate(in.width, in.height, in.depth, in.format)
 	defer avifImageDestroy(img)
 
-	if lossless {
-		img.MatrixCoefficients = avifMatrixCoefficientsIdentity
+	c := colorDescription(in, o)
+	img.ColorPrimaries = uint16(c.ColorPrimaries)
+	img.TransferCharacteristics = uint16(c.TransferCharacteristics)
+	img.MatrixCoefficients = uint16(c.MatrixCoefficients)
+	img.YuvRange = avifRangeLimited
+	if c.FullRange {
 		img.YuvRange = avifRangeFull
 	}
 
+	img.Clli.MaxCLL = uint16(o.MaxCLL)
+	img.Clli.MaxPALL = uint16(o.MaxPALL)
+
+	if in.premultiplied {
+		img.AlphaPremultiplied = 1
+	}
+
+	if in.yuv {
+		planes := avifPlanesYuv
+		if in.alpha {
+			planes = avifPlanesAll
+		}
+
+		if !avifImageAllocatePlanes(img, planes) {
+			return 0, ErrEncode
+		}
+	}
+
+	if len(o.ICC) > 0 {
+		if !avifImageSetProfileICC(img, o.ICC) {
+			return 0, ErrEncode
+		}
+	}
+
+	if len(o.Exif) > 0 {
+		if !avifImageSetMetadataExif(img, o.Exif) {
+			return 0, ErrEncode
+		}
+	}
+
+	if len(o.XMP) > 0 {
+		if !avifImageSetMetadataXMP(img, o.XMP) {
+			return 0, ErrEncode
+		}
+	}
+
+	if o.Orientation > 0 {
+		flags, angle, axis := irotImirFromExifOrientation(o.Orientation)
+		img.TransformFlags = uint32(flags)
+		img.Irot.Angle = uint8(angle)
+		img.Imir.Axis = uint8(axis)
+	}
+
+	if !in.crop.Empty() {
+		clap := cleanAperture(in.crop, in.width, in.height)
+		img.Clap = avifCleanApertureBox{
+			uint32(clap[0]), uint32(clap[1]), uint32(clap[2]), uint32(clap[3]),
+			uint32(clap[4]), uint32(clap[5]), uint32(clap[6]), uint32(clap[7]),
+		}
+		img.TransformFlags |= avifTransformClap
+	}
+
+	if o.PixelAspect.N > 0 && o.PixelAspect.D > 0 {
+		img.Pasp = avifPixelAspectRatioBox{uint32(o.PixelAspect.N), uint32(o.PixelAspect.D)}
+		img.TransformFlags |= avifTransformPasp
+	}
+
 	var rgb avifRGBImage
 	avifRGBImageSetDefaults(&rgb, img)
 
 	rgb.MaxThreads = int32(runtime.NumCPU())
-	rgb.AlphaPremultiplied = 1
+	if !in.straight {
+		rgb.AlphaPremultiplied = 1
+	}
 
-	if !avifRGBImageAllocatePixels(&rgb) {
-		return ErrEncode
+	if in.ignoreAlpha {
+		rgb.IgnoreAlpha = 1
 	}
-	defer avifRGBImageFreePixels(&rgb)
 
-	copy(unsafe.Slice(rgb.Pixels, rgb.RowBytes*rgb.Height), i.Pix)
+	rgb.ChromaDownsampling = uint32(o.ChromaDownsampling)
 
-	if !avifImageRGBToYuv(img, &rgb) {
-		return ErrEncode
+	if in.depth > 8 {
+		rgb.Depth = 16
 	}
 
+	if !in.yuv {
+		if !avifRGBImageAllocatePixels(&rgb) {
+			return 0, ErrEncode
+		}
+		defer avifRGBImageFreePixels(&rgb)
+	}
+
+	stats := Stats{Backend: "dynamic", Frames: len(images)}
+
+	if maxBytes == 0 {
+		out, err := encodeFrames(img, &rgb, in, images, durations, o, o.Quality, true, &stats)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = w.Write(out)
+		if err != nil {
+			return 0, fmt.Errorf("write: %w", err)
+		}
+
+		if o.Stats != nil {
+			*o.Stats = stats
+		}
+
+		return o.Quality, nil
+	}
+
+	// Binary search the highest quality that fits, the frame is converted on the first attempt only.
+	var best []byte
+	var kept Stats
+	quality, last := -1, 0
+
+	for lo, hi := 0, 100; lo <= hi; {
+		q := (lo + hi) / 2
+
+		out, err := encodeFrames(img, &rgb, in, images, durations, o, q, last == 0 && best == nil, &stats)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(out) <= maxBytes {
+			best, quality, kept = out, q, stats
+			lo = q + 1
+		} else {
+			last = len(out)
+			hi = q - 1
+		}
+	}
+
+	if best == nil {
+		return 0, fmt.Errorf("%w: smallest output is %d bytes", ErrTargetSize, last)
+	}
+
+	_, err = w.Write(best)
+	if err != nil {
+		return 0, fmt.Errorf("write: %w", err)
+	}
+
+	if o.Stats != nil {
+		stats.ColorSize, stats.AlphaSize = kept.ColorSize, kept.AlphaSize
+		*o.Stats = stats
+	}
+
+	return quality, nil
+}
+
+// encodeFrames runs one encoder over images at the given quality, converting the frames into img when convert is set.
+// The OBU sizes are set in stats and the times added to it.
+func encodeFrames(img *avifImage, rgb *avifRGBImage, in encodeInput, images []image.Image, durations []uint64,
+	o Options, quality int, convert bool, stats *Stats) ([]byte, error) {
+
+	start := time.Now()
+	var convertTime time.Duration
+
 	var output avifRWData
 	defer avifRWDataFree(&output)
 
 	encoder := avifEncoderCreate()
 	defer avifEncoderDestroy(encoder)
 
+	encoder.CodecChoice = uint32(o.Codec)
 	encoder.MaxThreads = int32(runtime.NumCPU())
 	encoder.Quality = int32(quality)
-	encoder.QualityAlpha = int32(qualityAlpha)
-	encoder.Speed = int32(speed)
+	encoder.QualityAlpha = int32(o.QualityAlpha)
+	encoder.MinQuantizer = int32(o.MinQuantizer)
+	encoder.MaxQuantizer = int32(o.MaxQuantizer)
+	encoder.MinQuantizerAlpha = int32(o.MinQuantizerAlpha)
+	encoder.MaxQuantizerAlpha = int32(o.MaxQuantizerAlpha)
+	encoder.Speed = int32(o.Speed)
+	encoder.Timescale = uint64(o.Timescale)
+	encoder.KeyframeInterval = int32(o.KeyframeInterval)
+	encoder.RepetitionCount = int32(repetitionCount(o.LoopCount))
+	encoder.TileRowsLog2 = int32(o.TileRows)
+	encoder.TileColsLog2 = int32(o.TileCols)
+
+	if o.AutoTiling {
+		encoder.AutoTiling = 1
+	}
+
+	if o.CompactHeader {
+		encoder.HeaderFormat = avifHeaderMini
+	}
+
+	scale := avifFraction{int32(o.Scale.N), int32(o.Scale.D)}
+	encoder.ScalingMode = avifScalingMode{scale, scale}
+
+	if len(o.Layers) > 0 {
+		encoder.ExtraLayerCount = uint32(len(o.Layers) - 1)
+	}
+
+	for _, k := range slices.Sorted(maps.Keys(o.CodecOptions)) {
+		if !avifEncoderSetCodecSpecificOption(encoder, k, o.CodecOptions[k]) {
+			return nil, fmt.Errorf("%w: %s", ErrEncode, toStr(encoder.Diag))
+		}
+	}
 
-	if !avifEncoderAddImage(encoder, img, 1, avifAddImageFlagSingle) {
-		return ErrEncode
+	flags := avifAddImageFlagNone
+	if len(images) == 1 {
+		flags = avifAddImageFlagSingle
+	}
+
+	for i, m := range images {
+		convertStart := time.Now()
+
+		if convert && in.yuv {
+			copyPlanes(img, in.pix(m), in.alpha)
+		} else if convert {
+			copy(unsafe.Slice(rgb.Pixels, rgb.RowBytes*rgb.Height), in.pix(m))
+
+			if !avifImageRGBToYuv(img, rgb) {
+				return nil, ErrEncode
+			}
+		}
+
+		convertTime += time.Since(convertStart)
+
+		if in.gridCols*in.gridRows > 1 {
+			if !addGrid(encoder, img, in.gridCols, in.gridRows) {
+				return nil, fmt.Errorf("%w: %s", ErrEncode, toStr(encoder.Diag))
+			}
+
+			continue
+		}
+
+		if len(o.Layers) > 0 {
+			for _, l := range o.Layers {
+				scale := avifFraction{int32(l.Scale.N), int32(l.Scale.D)}
+
+				encoder.Quality = int32(l.Quality)
+				encoder.ScalingMode = avifScalingMode{scale, scale}
+
+				if !avifEncoderAddImage(encoder, img, 1, avifAddImageFlagNone) {
+					return nil, fmt.Errorf("%w: %s", ErrEncode, toStr(encoder.Diag))
+				}
+			}
+
+			continue
+		}
+
+		if !avifEncoderAddImage(encoder, img, durations[i], flags) {
+			return nil, fmt.Errorf("%w: %s", ErrEncode, toStr(encoder.Diag))
+		}
 	}
 
 	if !avifEncoderFinish(encoder, &output) {
-		return ErrEncode
+		return nil, fmt.Errorf("%w: %s", ErrEncode, toStr(encoder.Diag))
 	}
 
-	_, err := w.Write(unsafe.Slice(output.Data, output.Size))
-	if err != nil {
-		return fmt.Errorf("write: %w", err)
+	stats.ColorSize = int(encoder.IoStats.ColorOBUSize)
+	stats.AlphaSize = int(encoder.IoStats.AlphaOBUSize)
+	stats.Convert += convertTime
+	stats.Codec += time.Since(start) - convertTime
+
+	return bytes.Clone(unsafe.Slice(output.Data, output.Size)), nil
+}
+
+// copyPlanes copies the tightly packed Y, U, V and optional alpha planes in pix into img.
+func copyPlanes(img *avifImage, pix []byte, alpha bool) {
+	bytes := 1
+	if img.Depth > 8 {
+		bytes = 2
 	}
 
-	return nil
+	width, height := int(img.Width), int(img.Height)
+	cw, ch := planeSize(int(img.YuvFormat), width, height)
+
+	copyPlane := func(plane *uint8, rowBytes uint32, w, h int) {
+		dst := unsafe.Slice(plane, int(rowBytes)*h)
+		for y := 0; y < h; y++ {
+			n := copy(dst[y*int(rowBytes):y*int(rowBytes)+w*bytes], pix)
+			pix = pix[n:]
+		}
+	}
+
+	copyPlane(img.YuvPlanes[0], img.YuvRowBytes[0], width, height)
+
+	for c := 1; c < 3; c++ {
+		if img.YuvPlanes[c] != nil {
+			copyPlane(img.YuvPlanes[c], img.YuvRowBytes[c], cw, ch)
+		}
+	}
+
+	if alpha {
+		copyPlane(img.AlphaPlane, img.AlphaRowBytes, width, height)
+	}
 }
 
 func init() {
@@ -219,44 +485,79 @@ func init() {
 	purego.RegisterLibFunc(&_avifImageRGBToYUV, libavif, "avifImageRGBToYUV")
 	purego.RegisterLibFunc(&_avifImageCreate, libavif, "avifImageCreate")
 	purego.RegisterLibFunc(&_avifImageDestroy, libavif, "avifImageDestroy")
+	purego.RegisterLibFunc(&_avifImageAllocatePlanes, libavif, "avifImageAllocatePlanes")
+	purego.RegisterLibFunc(&_avifImageCreateEmpty, libavif, "avifImageCreateEmpty")
+	purego.RegisterLibFunc(&_avifImageSetViewRect, libavif, "avifImageSetViewRect")
+	purego.RegisterLibFunc(&_avifImageSetProfileICC, libavif, "avifImageSetProfileICC")
+	purego.RegisterLibFunc(&_avifImageSetMetadataExif, libavif, "avifImageSetMetadataExif")
+	purego.RegisterLibFunc(&_avifImageSetMetadataXMP, libavif, "avifImageSetMetadataXMP")
 	purego.RegisterLibFunc(&_avifEncoderCreate, libavif, "avifEncoderCreate")
 	purego.RegisterLibFunc(&_avifEncoderDestroy, libavif, "avifEncoderDestroy")
+	purego.RegisterLibFunc(&_avifEncoderSetCodecSpecificOption, libavif, "avifEncoderSetCodecSpecificOption")
 	purego.RegisterLibFunc(&_avifEncoderAddImage, libavif, "avifEncoderAddImage")
+	purego.RegisterLibFunc(&_avifEncoderAddImageGrid, libavif, "avifEncoderAddImageGrid")
 	purego.RegisterLibFunc(&_avifEncoderFinish, libavif, "avifEncoderFinish")
+	purego.RegisterLibFunc(&_avifRWDataSet, libavif, "avifRWDataSet")
 	purego.RegisterLibFunc(&_avifRWDataFree, libavif, "avifRWDataFree")
+	purego.RegisterLibFunc(&_avifCodecName, libavif, "avifCodecName")
+	purego.RegisterLibFunc(&_avifCodecVersions, libavif, "avifCodecVersions")
 
 	major, minor := avifVersion()
 	if major != 1 || minor < 1 {
 		dynamic = false
 		dynamicErr = fmt.Errorf("minimum required libavif version is 1.1.0")
+
+		return
+	}
+
+	for codec := CodecAOM; codec < len(codecNames); codec++ {
+		codecFlags[codec] = avifCodecFlags(codec)
 	}
+
+	codecVersions = avifCodecVersions()
 }
 
 var (
 	libavif    uintptr
 	dynamic    bool
 	dynamicErr error
+
+	// codecFlags are the avifCodecFlags each codec of the loaded library supports, indexed by codec.
+	codecFlags [len(codecNames)]uint32
+	// codecVersions lists the codecs of the loaded library, e.g. "dav1d [dec]:1.4.3, aom [enc/dec]:3.9.1".
+	codecVersions string
 )
 
 var (
-	_avifVersion                func() string
-	_avifDecoderCreate          func() *avifDecoder
-	_avifDecoderDestroy         func(*avifDecoder)
-	_avifDecoderSetIOMemory     func(*avifDecoder, []byte, uint64) int
-	_avifDecoderParse           func(*avifDecoder) int
-	_avifDecoderNextImage       func(*avifDecoder) int
-	_avifRGBImageSetDefaults    func(*avifRGBImage, *avifImage)
-	_avifRGBImageAllocatePixels func(*avifRGBImage) int
-	_avifRGBImageFreePixels     func(*avifRGBImage)
-	_avifImageYUVToRGB          func(*avifImage, *avifRGBImage) int
-	_avifImageRGBToYUV          func(*avifImage, *avifRGBImage) int
-	_avifImageCreate            func(int, int, int, int) *avifImage
-	_avifImageDestroy           func(*avifImage)
-	_avifEncoderCreate          func() *avifEncoder
-	_avifEncoderDestroy         func(*avifEncoder)
-	_avifEncoderAddImage        func(*avifEncoder, *avifImage, uint64, int) int
-	_avifEncoderFinish          func(*avifEncoder, *avifRWData) int
-	_avifRWDataFree             func(*avifRWData)
+	_avifVersion                       func() string
+	_avifDecoderCreate                 func() *avifDecoder
+	_avifDecoderDestroy                func(*avifDecoder)
+	_avifDecoderSetIOMemory            func(*avifDecoder, []byte, uint64) int
+	_avifDecoderParse                  func(*avifDecoder) int
+	_avifDecoderNextImage              func(*avifDecoder) int
+	_avifRGBImageSetDefaults           func(*avifRGBImage, *avifImage)
+	_avifRGBImageAllocatePixels        func(*avifRGBImage) int
+	_avifRGBImageFreePixels            func(*avifRGBImage)
+	_avifImageYUVToRGB                 func(*avifImage, *avifRGBImage) int
+	_avifImageRGBToYUV                 func(*avifImage, *avifRGBImage) int
+	_avifImageCreate                   func(int, int, int, int) *avifImage
+	_avifImageDestroy                  func(*avifImage)
+	_avifImageAllocatePlanes           func(*avifImage, int) int
+	_avifImageCreateEmpty              func() *avifImage
+	_avifImageSetViewRect              func(*avifImage, *avifImage, *avifCropRect) int
+	_avifImageSetProfileICC            func(*avifImage, []byte, uint64) int
+	_avifImageSetMetadataExif          func(*avifImage, []byte, uint64) int
+	_avifImageSetMetadataXMP           func(*avifImage, []byte, uint64) int
+	_avifEncoderCreate                 func() *avifEncoder
+	_avifEncoderDestroy                func(*avifEncoder)
+	_avifEncoderSetCodecSpecificOption func(*avifEncoder, string, string) int
+	_avifEncoderAddImage               func(*avifEncoder, *avifImage, uint64, int) int
+	_avifEncoderAddImageGrid           func(*avifEncoder, uint32, uint32, **avifImage, int) int
+	_avifEncoderFinish                 func(*avifEncoder, *avifRWData) int
+	_avifRWDataSet                     func(*avifRWData, *uint8, uint64) int
+	_avifRWDataFree                    func(*avifRWData)
+	_avifCodecName                     func(uint32, uint32) string
+	_avifCodecVersions                 func(*byte)
 )
 
 func avifVersion() (int, int) {
@@ -268,6 +569,43 @@ func avifVersion() (int, int) {
 	return major, minor
 }
 
+// avifCodecFlags returns the avifCodecFlags the loaded library supports for codec, 0 when it is not built in.
+func avifCodecFlags(codec int) uint32 {
+	var flags uint32
+	for _, flag := range []uint32{avifCodecFlagCanDecode, avifCodecFlagCanEncode} {
+		if _avifCodecName(uint32(codec), flag) != "" {
+			flags |= flag
+		}
+	}
+
+	return flags
+}
+
+func avifCodecVersions() string {
+	var buf [256]byte
+	_avifCodecVersions(&buf[0])
+
+	str := string(buf[:])
+	if idx := strings.IndexByte(str, 0); idx != -1 {
+		str = str[:idx]
+	}
+
+	return str
+}
+
+// checkDynamicCodec reports a codec the loaded library cannot use for flag, encoding or decoding.
+func checkDynamicCodec(codec int, flag uint32) error {
+	if codec == CodecAuto {
+		return nil
+	}
+
+	if codec > CodecAuto && codec < len(codecNames) && codecFlags[codec]&flag != 0 {
+		return nil
+	}
+
+	return codecError(codec, flag == avifCodecFlagCanEncode, fmt.Sprintf("the loaded libavif (%s)", codecVersions))
+}
+
 func avifDecoderCreate() *avifDecoder {
 	return _avifDecoderCreate()
 }
@@ -322,6 +660,35 @@ func avifImageDestroy(img *avifImage) {
 	_avifImageDestroy(img)
 }
 
+func avifImageAllocatePlanes(img *avifImage, planes int) bool {
+	ret := _avifImageAllocatePlanes(img, planes)
+	return ret == 0
+}
+
+func avifImageSetProfileICC(img *avifImage, icc []byte) bool {
+	ret := _avifImageSetProfileICC(img, icc, uint64(len(icc)))
+	return ret == 0
+}
+
+func avifImageSetMetadataExif(img *avifImage, exif []byte) bool {
+	ret := _avifImageSetMetadataExif(img, exif, uint64(len(exif)))
+	return ret == 0
+}
+
+func avifImageSetMetadataXMP(img *avifImage, xmp []byte) bool {
+	ret := _avifImageSetMetadataXMP(img, xmp, uint64(len(xmp)))
+	return ret == 0
+}
+
+func avifImageCreateEmpty() *avifImage {
+	return _avifImageCreateEmpty()
+}
+
+func avifImageSetViewRect(dst, src *avifImage, rect *avifCropRect) bool {
+	ret := _avifImageSetViewRect(dst, src, rect)
+	return ret == 0
+}
+
 func avifEncoderCreate() *avifEncoder {
 	return _avifEncoderCreate()
 }
@@ -330,20 +697,67 @@ func avifEncoderDestroy(encoder *avifEncoder) {
 	_avifEncoderDestroy(encoder)
 }
 
+func avifEncoderSetCodecSpecificOption(encoder *avifEncoder, key, value string) bool {
+	ret := _avifEncoderSetCodecSpecificOption(encoder, key, value)
+	return ret == 0
+}
+
 func avifEncoderAddImage(encoder *avifEncoder, img *avifImage, durationInTimescales uint64, flags int) bool {
 	ret := _avifEncoderAddImage(encoder, img, durationInTimescales, flags)
 	return ret == 0
 }
 
+func avifEncoderAddImageGrid(encoder *avifEncoder, cols, rows int, cells []*avifImage, flags int) bool {
+	ret := _avifEncoderAddImageGrid(encoder, uint32(cols), uint32(rows), &cells[0], flags)
+	return ret == 0
+}
+
 func avifEncoderFinish(encoder *avifEncoder, output *avifRWData) bool {
 	ret := _avifEncoderFinish(encoder, output)
 	return ret == 0
 }
 
+func avifRWDataSet(raw *avifRWData, src avifRWData) bool {
+	ret := _avifRWDataSet(raw, src.Data, src.Size)
+	return ret == 0
+}
+
 func avifRWDataFree(output *avifRWData) {
 	_avifRWDataFree(output)
 }
 
+// addGrid adds img as a cols x rows grid of views, copying the ICC, Exif and XMP onto the first cell
+// that libavif reads them from.
+func addGrid(encoder *avifEncoder, img *avifImage, cols, rows int) bool {
+	cw, ch := img.Width/uint32(cols), img.Height/uint32(rows)
+
+	cells := make([]*avifImage, 0, cols*rows)
+	defer func() {
+		for _, cell := range cells {
+			avifImageDestroy(cell)
+		}
+	}()
+
+	for i := 0; i < cols*rows; i++ {
+		cell := avifImageCreateEmpty()
+		if cell == nil {
+			return false
+		}
+		cells = append(cells, cell)
+
+		rect := avifCropRect{X: uint32(i%cols) * cw, Y: uint32(i/cols) * ch, Width: cw, Height: ch}
+		if !avifImageSetViewRect(cell, img, &rect) {
+			return false
+		}
+	}
+
+	if !avifRWDataSet(&cells[0].Icc, img.Icc) || !avifRWDataSet(&cells[0].Exif, img.Exif) || !avifRWDataSet(&cells[0].Xmp, img.Xmp) {
+		return false
+	}
+
+	return avifEncoderAddImageGrid(encoder, cols, rows, cells, avifAddImageFlagSingle)
+}
+
 func toStr(diagnostics avifDiagnostics) string {
 	str := string(diagnostics.Error[:])
 	idx := strings.Index(str, "\x00")
@@ -425,6 +839,13 @@ type avifRGBImage struct {
 	_                  [4]byte
 }
 
+type avifCropRect struct {
+	X      uint32
+	Y      uint32
+	Width  uint32
+	Height uint32
+}
+
 type avifRWData struct {
 	Data *uint8
 	Size uint64
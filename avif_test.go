@@ -3,13 +3,19 @@ package avif
 import (
 	"bytes"
 	_ "embed"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"image/jpeg"
 	"io"
+	"math"
 	"os"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 //go:embed testdata/test8.avif
@@ -22,7 +28,7 @@ var testAvif10 []byte
 var testAvifAnim []byte
 
 func TestDecode(t *testing.T) {
-	img, _, err := decode(bytes.NewReader(testAvif8), false, false)
+	img, _, err := decode(bytes.NewReader(testAvif8), false, false, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -40,7 +46,7 @@ func TestDecode(t *testing.T) {
 }
 
 func TestDecode10(t *testing.T) {
-	img, _, err := decode(bytes.NewReader(testAvif10), false, false)
+	img, _, err := decode(bytes.NewReader(testAvif10), false, false, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -63,7 +69,7 @@ func TestDecodeDynamic(t *testing.T) {
 		t.Skip()
 	}
 
-	img, _, err := decodeDynamic(bytes.NewReader(testAvif8), false, false)
+	img, _, err := decodeDynamic(bytes.NewReader(testAvif8), false, false, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -86,7 +92,7 @@ func TestDecode10Dynamic(t *testing.T) {
 		t.Skip()
 	}
 
-	img, _, err := decodeDynamic(bytes.NewReader(testAvif10), false, false)
+	img, _, err := decodeDynamic(bytes.NewReader(testAvif10), false, false, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -104,7 +110,7 @@ func TestDecode10Dynamic(t *testing.T) {
 }
 
 func TestDecodeAnim(t *testing.T) {
-	ret, _, err := decode(bytes.NewReader(testAvifAnim), false, true)
+	ret, _, err := decode(bytes.NewReader(testAvifAnim), false, true, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -131,7 +137,7 @@ func TestDecodeAnimDynamic(t *testing.T) {
 		t.Skip()
 	}
 
-	ret, _, err := decodeDynamic(bytes.NewReader(testAvifAnim), false, true)
+	ret, _, err := decodeDynamic(bytes.NewReader(testAvifAnim), false, true, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -189,7 +195,7 @@ func TestImageDecodeAnim(t *testing.T) {
 }
 
 func TestDecodeConfig(t *testing.T) {
-	_, cfg, err := decode(bytes.NewReader(testAvif8), true, false)
+	_, cfg, err := decode(bytes.NewReader(testAvif8), true, false, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -209,7 +215,7 @@ func TestDecodeConfigDynamic(t *testing.T) {
 		t.Skip()
 	}
 
-	_, cfg, err := decodeDynamic(bytes.NewReader(testAvif8), true, false)
+	_, cfg, err := decodeDynamic(bytes.NewReader(testAvif8), true, false, Options{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -235,7 +241,7 @@ func TestEncode(t *testing.T) {
 	}
 	defer w.Close()
 
-	err = encode(w, img, DefaultQuality, DefaultQuality, DefaultSpeed, image.YCbCrSubsampleRatio420, false)
+	err = encode(w, []image.Image{img}, []uint64{1}, encodeOptions(nil))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -258,12 +264,1625 @@ func TestEncodeDynamic(t *testing.T) {
 	}
 	defer w.Close()
 
-	err = encodeDynamic(w, img, DefaultQuality, DefaultQuality, DefaultSpeed, image.YCbCrSubsampleRatio420, false)
+	err = encodeDynamic(w, []image.Image{img}, []uint64{1}, encodeOptions(nil))
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
+func TestEncode10(t *testing.T) {
+	skipLegacy(t)
+
+	img, err := Decode(bytes.NewReader(testAvif10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	err = encode(&b, []image.Image{img}, []uint64{1}, encodeOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, ok := parseAVIFProps(b.Bytes())
+	if !ok {
+		t.Fatal("no dimensions parsed")
+	}
+
+	if !p.hiDepth {
+		t.Error("expected hiDepth for RGBA64 input")
+	}
+}
+
+func TestEncode10Dynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img, err := Decode(bytes.NewReader(testAvif10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	err = encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Depth: 12}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, ok := parseAVIFProps(b.Bytes())
+	if !ok {
+		t.Fatal("no dimensions parsed")
+	}
+
+	if !p.hiDepth {
+		t.Error("expected hiDepth for 12-bit encode")
+	}
+}
+
+func TestEncodeYCbCr(t *testing.T) {
+	img := testYCbCr(image.YCbCrSubsampleRatio420)
+
+	var b bytes.Buffer
+	err := encode(&b, []image.Image{img}, []uint64{1}, encodeOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, cfg, err := decode(bytes.NewReader(b.Bytes()), true, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Width != 67 || cfg.Height != 33 {
+		t.Errorf("got %dx%d, want 67x33", cfg.Width, cfg.Height)
+	}
+}
+
+func TestEncodeYCbCrDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img := testYCbCr(image.YCbCrSubsampleRatio422)
+
+	var b bytes.Buffer
+	err := encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, cfg, err := decodeDynamic(bytes.NewReader(b.Bytes()), true, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Width != 67 || cfg.Height != 33 {
+		t.Errorf("got %dx%d, want 67x33", cfg.Width, cfg.Height)
+	}
+}
+
+func TestEncodeInputYCbCr(t *testing.T) {
+	img := testYCbCr(image.YCbCrSubsampleRatio420)
+
+	in, err := newEncodeInput([]image.Image{img}, encodeOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !in.yuv || in.format != avifPixelFormatYuv420 {
+		t.Fatalf("got yuv=%v format=%d, want yuv 4:2:0", in.yuv, in.format)
+	}
+
+	pix := in.pix(img)
+	if len(pix) != in.frameSize() || len(pix) != 67*33+2*34*17 {
+		t.Errorf("got %d bytes, want %d", len(pix), in.frameSize())
+	}
+
+	if pix[67*33] != img.Cb[0] || pix[len(pix)-1] != img.Cr[len(img.Cr)-1] {
+		t.Error("chroma planes not copied")
+	}
+
+	in, err = newEncodeInput([]image.Image{testYCbCr(image.YCbCrSubsampleRatio410)}, encodeOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if in.yuv {
+		t.Error("expected 4:1:0 to go through RGB")
+	}
+}
+
+func TestEncodeGray(t *testing.T) {
+	skipLegacy(t)
+
+	img := image.NewGray(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+
+	var b bytes.Buffer
+	err := encode(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Lossless: true}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := DecodeConfig(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ColorModel != color.GrayModel {
+		t.Error("expected GrayModel")
+	}
+
+	ret, _, err := decode(bytes.NewReader(b.Bytes()), false, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gray, ok := imageToGray(ret.Image[0]).(*image.Gray)
+	if !ok {
+		t.Fatal("expected *image.Gray")
+	}
+
+	if !bytes.Equal(gray.Pix, img.Pix) {
+		t.Error("lossless monochrome round trip changed pixels")
+	}
+}
+
+func TestEncodeGrayDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img := image.NewGray16(image.Rect(0, 0, 64, 48))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+
+	var b bytes.Buffer
+	err := encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := DecodeConfig(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ColorModel != color.Gray16Model {
+		t.Error("expected Gray16Model")
+	}
+}
+
+func TestEncodeICC(t *testing.T) {
+	skipLegacy(t)
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	icc := testICC()
+
+	var b bytes.Buffer
+	err = encode(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{ICC: icc}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(b.Bytes(), append([]byte("colrprof"), icc...)) {
+		t.Error("ICC profile not stored in colr box")
+	}
+}
+
+func TestEncodeICCDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	icc := testICC()
+
+	var b bytes.Buffer
+	err = encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{ICC: icc}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(b.Bytes(), append([]byte("colrprof"), icc...)) {
+		t.Error("ICC profile not stored in colr box")
+	}
+}
+
+func TestEncodeColor(t *testing.T) {
+	skipLegacy(t)
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &CICP{ColorPrimariesBT709, TransferCharacteristicsBT709, MatrixCoefficientsBT709, false}
+
+	var b bytes.Buffer
+	err = encode(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Color: c}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testColor(t, b.Bytes(), *c)
+}
+
+func TestEncodeColorDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &CICP{ColorPrimariesBT709, TransferCharacteristicsBT709, MatrixCoefficientsBT709, false}
+
+	var b bytes.Buffer
+	err = encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Color: c}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testColor(t, b.Bytes(), *c)
+}
+
+func testColor(t *testing.T, data []byte, want CICP) {
+	t.Helper()
+
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Color == nil {
+		t.Fatal("no nclx color description")
+	}
+
+	if *meta.Color != want {
+		t.Errorf("got %+v, want %+v", *meta.Color, want)
+	}
+}
+
+func TestEncodeTiles(t *testing.T) {
+	skipLegacy(t)
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, o := range []Options{{TileRows: 1, TileCols: 2}, {AutoTiling: true}} {
+		var b bytes.Buffer
+		err = encode(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{o}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := DecodeConfig(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cfg.Width != 512 || cfg.Height != 512 {
+			t.Errorf("got %dx%d, want 512x512", cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func TestEncodeTilesDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, o := range []Options{{TileRows: 1, TileCols: 2}, {AutoTiling: true}} {
+		var b bytes.Buffer
+		err = encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{o}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := DecodeConfig(bytes.NewReader(b.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cfg.Width != 512 || cfg.Height != 512 {
+			t.Errorf("got %dx%d, want 512x512", cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func TestEncodeOptionsTiles(t *testing.T) {
+	o := encodeOptions([]Options{{TileRows: -1, TileCols: 9}})
+	if o.TileRows != 0 || o.TileCols != 6 {
+		t.Errorf("got %d/%d, want 0/6", o.TileRows, o.TileCols)
+	}
+}
+
+func TestEncodeQuantizer(t *testing.T) {
+	skipLegacy(t)
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var best, worst bytes.Buffer
+	err = encode(&best, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{MinQuantizer: 0, MaxQuantizer: 10}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encode(&worst, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{MinQuantizer: 50, MaxQuantizer: 63}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if worst.Len() >= best.Len() {
+		t.Errorf("got %d bytes for [50,63], want less than %d for [0,10]", worst.Len(), best.Len())
+	}
+}
+
+func TestEncodeQuantizerDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var best, worst bytes.Buffer
+	err = encodeDynamic(&best, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{MinQuantizer: 0, MaxQuantizer: 10}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encodeDynamic(&worst, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{MinQuantizer: 50, MaxQuantizer: 63}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if worst.Len() >= best.Len() {
+		t.Errorf("got %d bytes for [50,63], want less than %d for [0,10]", worst.Len(), best.Len())
+	}
+}
+
+func TestEncodeOptionsQuantizers(t *testing.T) {
+	o := encodeOptions([]Options{{Quality: 80}})
+	if o.Quality != 80 || o.MinQuantizer != 0 || o.MaxQuantizer != 63 {
+		t.Errorf("unset: got quality %d, range [%d,%d]", o.Quality, o.MinQuantizer, o.MaxQuantizer)
+	}
+
+	o = encodeOptions([]Options{{Quality: 80, MinQuantizer: 10, MaxQuantizer: 40}})
+	if o.Quality != avifQualityDefault || o.QualityAlpha != DefaultQuality {
+		t.Errorf("set: got quality %d, alpha %d", o.Quality, o.QualityAlpha)
+	}
+
+	o = encodeOptions([]Options{{MinQuantizer: 10, MinQuantizerAlpha: 20}})
+	if o.Quality != avifQualityDefault || o.MaxQuantizer != 63 || o.QualityAlpha != avifQualityDefault || o.MaxQuantizerAlpha != 63 {
+		t.Errorf("min only: got quality %d, range [%d,%d], alpha %d, range [%d,%d]",
+			o.Quality, o.MinQuantizer, o.MaxQuantizer, o.QualityAlpha, o.MinQuantizerAlpha, o.MaxQuantizerAlpha)
+	}
+
+	if err := checkOptions(o); err != nil {
+		t.Errorf("min only: %v", err)
+	}
+
+	for _, o := range []Options{{MinQuantizer: 40, MaxQuantizer: 10}, {MaxQuantizer: 64}, {MinQuantizerAlpha: -1, MaxQuantizerAlpha: 5}} {
+		if err := Encode(io.Discard, image.NewRGBA(image.Rect(0, 0, 8, 8)), o); err == nil {
+			t.Errorf("%+v: expected error", o)
+		}
+	}
+}
+
+func TestEncodeCodecOptions(t *testing.T) {
+	skipLegacy(t)
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encode(io.Discard, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{
+		CodecOptions: map[string]string{"tune": "ssim", "sharpness": "2", "color:enable-chroma-deltaq": "1"},
+	}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encode(io.Discard, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{
+		CodecOptions: map[string]string{"no-such-option": "1"},
+	}}))
+	if err == nil || !strings.Contains(err.Error(), "no-such-option") {
+		t.Errorf("got %v, want an error naming the key", err)
+	}
+}
+
+func TestEncodeCodecOptionsDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encodeDynamic(io.Discard, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{
+		CodecOptions: map[string]string{"tune": "ssim", "sharpness": "2", "color:enable-chroma-deltaq": "1"},
+	}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = encodeDynamic(io.Discard, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{
+		CodecOptions: map[string]string{"no-such-option": "1"},
+	}}))
+	if err == nil || !strings.Contains(err.Error(), "no-such-option") {
+		t.Errorf("got %v, want an error naming the key", err)
+	}
+}
+
+func TestCodecOptions(t *testing.T) {
+	got := codecOptions(map[string]string{"tune": "ssim", "sharpness": "2"})
+	if want := "sharpness\x002\x00tune\x00ssim\x00"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := checkOptions(Options{CodecOptions: map[string]string{"": "1"}}); err == nil {
+		t.Error("expected error for empty key")
+	}
+}
+
+func TestEncodeLayers(t *testing.T) {
+	skipLegacy(t)
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	err = encode(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Layers: testLayers}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testLayered(t, b.Bytes())
+}
+
+func TestEncodeLayersDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	err = encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Layers: testLayers}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testLayered(t, b.Bytes())
+}
+
+var testLayers = []Layer{{Quality: 10, Scale: Fraction{1, 4}}, {Quality: 70}}
+
+func testLayered(t *testing.T, data []byte) {
+	t.Helper()
+
+	if !bytes.Contains(data, []byte("a1lx")) {
+		t.Error("no layer sizes (a1lx) stored")
+	}
+
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 512 || b.Dy() != 512 {
+		t.Errorf("got %dx%d, want 512x512", b.Dx(), b.Dy())
+	}
+}
+
+func TestEncodeOptionsLayers(t *testing.T) {
+	o := encodeOptions([]Options{{Layers: []Layer{{Quality: 200}, {}}}})
+	if o.Layers[0].Quality != 100 || o.Layers[1].Quality != DefaultQuality || o.Layers[1].Scale != (Fraction{1, 1}) {
+		t.Errorf("got %+v", o.Layers)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+
+	for _, o := range []Options{{Layers: make([]Layer, 5)}, {Layers: []Layer{{Scale: Fraction{3, 2}}}}} {
+		if err := Encode(io.Discard, img, o); err == nil {
+			t.Errorf("%+v: expected error", o)
+		}
+	}
+
+	err := EncodeAll(io.Discard, &AVIF{Image: []image.Image{img, img}, Delay: []float64{0.1, 0.1}}, Options{Layers: testLayers})
+	if err == nil {
+		t.Error("expected error for layered animation")
+	}
+}
+
+func TestEncodeGrid(t *testing.T) {
+	skipLegacy(t)
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	err = encode(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{GridCols: 2, GridRows: 2}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testGrid(t, b.Bytes())
+
+	b.Reset()
+	err = encode(&b, []image.Image{testWide()}, []uint64{1}, encodeOptions([]Options{{Speed: 10}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testPaddedGrid(t, b.Bytes())
+}
+
+func TestEncodeGridDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	err = encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{GridCols: 2, GridRows: 2}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testGrid(t, b.Bytes())
+
+	b.Reset()
+	err = encodeDynamic(&b, []image.Image{testWide()}, []uint64{1}, encodeOptions([]Options{{Speed: 10}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testPaddedGrid(t, b.Bytes())
+}
+
+func testGrid(t *testing.T, data []byte) {
+	t.Helper()
+
+	if !bytes.Contains(data, []byte("grid")) {
+		t.Error("no grid item stored")
+	}
+
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 512 || b.Dy() != 512 {
+		t.Errorf("got %dx%d, want 512x512", b.Dx(), b.Dy())
+	}
+}
+
+// testWide returns a gray image over the AV1 frame width whose width has no even divisor.
+func testWide() *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 16411, 64))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+
+	return img
+}
+
+func testPaddedGrid(t *testing.T, data []byte) {
+	t.Helper()
+
+	cfg, err := DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Width != 16411 || cfg.Height != 64 {
+		t.Errorf("config: got %dx%d, want 16411x64", cfg.Width, cfg.Height)
+	}
+
+	img, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 16411 || b.Dy() != 64 {
+		t.Errorf("got %dx%d, want 16411x64", b.Dx(), b.Dy())
+	}
+}
+
+func TestGridLayout(t *testing.T) {
+	cases := []struct {
+		width, height, cols, rows int
+		wantCols, wantRows        int
+		wantWidth, wantHeight     int
+	}{
+		{512, 512, 0, 0, 1, 1, 512, 512},
+		{512, 512, 2, 0, 2, 1, 512, 512},
+		{40000, 5000, 0, 0, 3, 2, 40002, 5000},
+		{20000, 640, 0, 0, 2, 1, 20000, 640},
+		{16411, 64, 0, 0, 2, 1, 16412, 64},
+		{30011, 9001, 0, 0, 2, 4, 30012, 9008},
+	}
+
+	for _, c := range cases {
+		cols, rows, err := gridLayout(c.width, c.height, avifPixelFormatYuv420, c.cols, c.rows)
+		if err != nil {
+			t.Errorf("%dx%d: %v", c.width, c.height, err)
+			continue
+		}
+
+		if cols != c.wantCols || rows != c.wantRows {
+			t.Errorf("%dx%d: got %dx%d grid, want %dx%d", c.width, c.height, cols, rows, c.wantCols, c.wantRows)
+		}
+
+		width, height := gridSize(c.width, c.height, avifPixelFormatYuv420, cols, rows)
+		if width != c.wantWidth || height != c.wantHeight {
+			t.Errorf("%dx%d: got %dx%d padded, want %dx%d", c.width, c.height, width, height, c.wantWidth, c.wantHeight)
+		}
+	}
+
+	if _, _, err := gridLayout(512, 512, avifPixelFormatYuv420, 3, 1); err == nil {
+		t.Error("expected error for unequal cells")
+	}
+
+	if _, _, err := gridLayout(200, 200, avifPixelFormatYuv420, 4, 4); err == nil {
+		t.Error("expected error for cells under 64 pixels")
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 128, 128))
+	if _, err := newEncodeInput([]image.Image{img, img}, encodeOptions([]Options{{GridCols: 2}})); err == nil {
+		t.Error("expected error for a grid animation")
+	}
+
+	wide := image.NewGray(image.Rect(0, 0, 16411, 64))
+	wide.SetGray(16410, 63, color.Gray{Y: 200})
+
+	in, err := newEncodeInput([]image.Image{wide}, encodeOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if in.width != 16412 || in.height != 64 || in.crop != wide.Rect {
+		t.Errorf("got %dx%d with crop %v, want 16412x64 with crop %v", in.width, in.height, in.crop, wide.Rect)
+	}
+
+	pix := in.pix(wide)
+	if len(pix) != in.frameSize() || pix[63*16412+16411] != 200 {
+		t.Errorf("padded column not repeated from the source edge")
+	}
+}
+
+func TestPadImage(t *testing.T) {
+	src := image.NewYCbCr(image.Rect(0, 0, 3, 3), image.YCbCrSubsampleRatio420)
+	for i := range src.Y {
+		src.Y[i] = byte(i)
+	}
+
+	for i := range src.Cb {
+		src.Cb[i], src.Cr[i] = byte(10+i), byte(20+i)
+	}
+
+	dst, ok := padImage(src, 4, 4).(*image.YCbCr)
+	if !ok {
+		t.Fatal("padded Y'CbCr image changed type")
+	}
+
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if got, want := dst.YCbCrAt(x, y), src.YCbCrAt(min(x, 2), min(y, 2)); got != want {
+				t.Errorf("(%d,%d): got %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeToSize(t *testing.T) {
+	skipLegacy(t)
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	quality, err := encodeToSize(&b, []image.Image{img}, []uint64{1}, encodeOptions(nil), 20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testToSize(t, b.Bytes(), quality, 20000)
+}
+
+func TestEncodeToSizeDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	quality, err := encodeDynamicToSize(&b, []image.Image{img}, []uint64{1}, encodeOptions(nil), 20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testToSize(t, b.Bytes(), quality, 20000)
+
+	_, err = encodeDynamicToSize(io.Discard, []image.Image{img}, []uint64{1}, encodeOptions(nil), 10)
+	if !errors.Is(err, ErrTargetSize) {
+		t.Errorf("got %v, want ErrTargetSize", err)
+	}
+}
+
+func testToSize(t *testing.T, data []byte, quality, maxBytes int) {
+	t.Helper()
+
+	if len(data) == 0 || len(data) > maxBytes {
+		t.Errorf("got %d bytes, want at most %d", len(data), maxBytes)
+	}
+
+	if quality < 0 || quality > 100 {
+		t.Errorf("got quality %d", quality)
+	}
+
+	if _, err := Decode(bytes.NewReader(data)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncodeToSizeOptions(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+
+	if _, err := EncodeToSize(io.Discard, img, 0); err == nil {
+		t.Error("expected error for zero size")
+	}
+
+	if _, err := EncodeToSize(io.Discard, img, 1000, Options{Layers: []Layer{{}, {}}}); err == nil {
+		t.Error("expected error for layers")
+	}
+}
+
+func TestEncodeStraightAlpha(t *testing.T) {
+	skipLegacy(t)
+
+	img := testStraight()
+
+	var b bytes.Buffer
+	err := encode(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Lossless: true}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, _, err := decode(bytes.NewReader(b.Bytes()), false, false, Options{StraightAlpha: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStraightAlpha(t, img, ret.Image[0])
+}
+
+func TestEncodeStraightAlphaDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img := testStraight()
+
+	var b bytes.Buffer
+	err := encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Lossless: true}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, _, err := decodeDynamic(bytes.NewReader(b.Bytes()), false, false, Options{StraightAlpha: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStraightAlpha(t, img, ret.Image[0])
+
+	b.Reset()
+	err = encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{PremultipliedAlpha: true}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(b.Bytes(), []byte("prem")) {
+		t.Error("no prem reference stored")
+	}
+}
+
+// testStraight returns a semi-transparent image whose color does not survive 8-bit premultiplication.
+func testStraight() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: 200, G: uint8(x * 4), B: uint8(y * 4), A: 8})
+		}
+	}
+
+	return img
+}
+
+func testStraightAlpha(t *testing.T, want *image.NRGBA, got image.Image) {
+	t.Helper()
+
+	img, ok := got.(*image.NRGBA)
+	if !ok {
+		t.Fatalf("got %T, want *image.NRGBA", got)
+	}
+
+	if !bytes.Equal(img.Pix, want.Pix) {
+		t.Errorf("got %v, want %v", img.Pix[:4], want.Pix[:4])
+	}
+}
+
+func TestFramePixStraight(t *testing.T) {
+	img := image.NewNRGBA64(image.Rect(0, 0, 1, 1))
+	img.SetNRGBA64(0, 0, color.NRGBA64{R: 0xc8c8, G: 0x6464, B: 0x3232, A: 0x0808})
+
+	if pix := framePix(img, 8, true); !bytes.Equal(pix, []byte{0xc8, 0x64, 0x32, 0x08}) {
+		t.Errorf("straight: got %v", pix)
+	}
+
+	if pix := framePix(img, 8, false); bytes.Equal(pix, []byte{0xc8, 0x64, 0x32, 0x08}) {
+		t.Errorf("premultiplied: got %v", pix)
+	}
+
+	in, err := newEncodeInput([]image.Image{img}, encodeOptions(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !in.straight {
+		t.Error("expected straight alpha for NRGBA64 input")
+	}
+
+	src := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+	src.Pix = []byte{0xc8, 0x64, 0x32, 0x08}
+
+	if got := imageToNRGBA64(src).NRGBA64At(0, 0); got != (color.NRGBA64{R: 0xc8c8, G: 0x6464, B: 0x3232, A: 0x0808}) {
+		t.Errorf("NRGBA64: got %v", got)
+	}
+}
+
+func TestEncodeLosslessAlpha(t *testing.T) {
+	skipLegacy(t)
+
+	img := testAlpha()
+
+	var b bytes.Buffer
+	err := encode(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Quality: 30, LosslessAlpha: true}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, _, err := decode(bytes.NewReader(b.Bytes()), false, false, Options{StraightAlpha: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testLosslessAlpha(t, img, ret.Image[0])
+}
+
+func TestEncodeLosslessAlphaDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img := testAlpha()
+
+	var b bytes.Buffer
+	err := encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Quality: 30, LosslessAlpha: true}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret, _, err := decodeDynamic(bytes.NewReader(b.Bytes()), false, false, Options{StraightAlpha: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testLosslessAlpha(t, img, ret.Image[0])
+
+	opaque := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(opaque, opaque.Bounds(), image.White, image.Point{}, draw.Src)
+
+	b.Reset()
+	err = encodeDynamic(&b, []image.Image{opaque, opaque}, []uint64{1, 1}, encodeOptions([]Options{{DropOpaqueAlpha: true}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(b.Bytes(), []byte("auxiliary:alpha")) {
+		t.Error("alpha stored for an opaque animation")
+	}
+}
+
+// testAlpha returns an image with a gradient in every channel.
+func testAlpha() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 4), G: uint8(y * 4), B: 128, A: uint8(x*y) | 1})
+		}
+	}
+
+	return img
+}
+
+func testLosslessAlpha(t *testing.T, want *image.NRGBA, got image.Image) {
+	t.Helper()
+
+	img, ok := got.(*image.NRGBA)
+	if !ok {
+		t.Fatalf("got %T, want *image.NRGBA", got)
+	}
+
+	for i := 3; i < len(want.Pix); i += 4 {
+		if img.Pix[i] != want.Pix[i] {
+			t.Fatalf("alpha at %d: got %d, want %d", i/4, img.Pix[i], want.Pix[i])
+		}
+	}
+}
+
+func TestEncodeOptionsAlpha(t *testing.T) {
+	o := encodeOptions([]Options{{QualityAlpha: 20, MinQuantizerAlpha: 10, MaxQuantizerAlpha: 40, LosslessAlpha: true}})
+	if o.QualityAlpha != 100 || o.MinQuantizerAlpha != 0 || o.MaxQuantizerAlpha != 63 {
+		t.Errorf("got alpha quality %d, range [%d,%d]", o.QualityAlpha, o.MinQuantizerAlpha, o.MaxQuantizerAlpha)
+	}
+
+	opaque := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(opaque, opaque.Bounds(), image.White, image.Point{}, draw.Src)
+
+	in, err := newEncodeInput([]image.Image{opaque}, encodeOptions([]Options{{DropOpaqueAlpha: true}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !in.ignoreAlpha {
+		t.Error("expected alpha to be dropped for an opaque image")
+	}
+
+	in, err = newEncodeInput([]image.Image{opaque, testAlpha()}, encodeOptions([]Options{{DropOpaqueAlpha: true}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if in.ignoreAlpha {
+		t.Error("alpha dropped for a translucent frame")
+	}
+
+	ycc := image.NewNYCbCrA(image.Rect(0, 0, 8, 8), image.YCbCrSubsampleRatio420)
+	for i := range ycc.A {
+		ycc.A[i] = 0xff
+	}
+
+	in, err = newEncodeInput([]image.Image{ycc}, encodeOptions([]Options{{DropOpaqueAlpha: true}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if in.alpha || in.frameSize() != 8*8+2*4*4 {
+		t.Errorf("got alpha %v, frame size %d for an opaque NYCbCrA image", in.alpha, in.frameSize())
+	}
+}
+
+func TestEncodeCompactHeader(t *testing.T) {
+	skipLegacy(t)
+
+	img := testAlpha()
+
+	var full, mini bytes.Buffer
+	if err := encode(&full, []image.Image{img}, []uint64{1}, encodeOptions(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := encode(&mini, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{CompactHeader: true}})); err != nil {
+		t.Fatal(err)
+	}
+
+	testCompactHeader(t, full.Bytes(), mini.Bytes())
+}
+
+func TestEncodeCompactHeaderDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img := testAlpha()
+
+	var full, mini bytes.Buffer
+	if err := encodeDynamic(&full, []image.Image{img}, []uint64{1}, encodeOptions(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := encodeDynamic(&mini, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{CompactHeader: true}})); err != nil {
+		t.Fatal(err)
+	}
+
+	testCompactHeader(t, full.Bytes(), mini.Bytes())
+}
+
+func testCompactHeader(t *testing.T, full, mini []byte) {
+	t.Helper()
+
+	if _, ok := miniPayload(mini); !ok {
+		t.Fatal("no mini box written")
+	}
+
+	if len(mini) >= len(full) {
+		t.Errorf("got %d bytes, want fewer than %d", len(mini), len(full))
+	}
+
+	cfg, err := DecodeConfig(bytes.NewReader(mini))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Width != 64 || cfg.Height != 64 {
+		t.Errorf("got %dx%d, want 64x64", cfg.Width, cfg.Height)
+	}
+}
+
+func TestEncodeSharpYUV(t *testing.T) {
+	skipLegacy(t)
+
+	img := testRedText()
+
+	var def, sharp bytes.Buffer
+	if err := encode(&def, []image.Image{img}, []uint64{1}, encodeOptions(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := encode(&sharp, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{SharpYUV: true}})); err != nil {
+		t.Fatal(err)
+	}
+
+	testSharpYUV(t, def.Bytes(), sharp.Bytes())
+}
+
+func TestEncodeSharpYUVDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img := testRedText()
+
+	var def, sharp bytes.Buffer
+	if err := encodeDynamic(&def, []image.Image{img}, []uint64{1}, encodeOptions(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := encodeDynamic(&sharp, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{SharpYUV: true}})); err != nil {
+		t.Fatal(err)
+	}
+
+	testSharpYUV(t, def.Bytes(), sharp.Bytes())
+}
+
+// testRedText returns one pixel wide red lines on white, which bleed with plain 4:2:0 averaging.
+func testRedText() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+
+	for y := 0; y < 64; y++ {
+		for x := 1; x < 64; x += 3 {
+			img.SetRGBA(x, y, color.RGBA{R: 0xff, A: 0xff})
+		}
+	}
+
+	return img
+}
+
+func testSharpYUV(t *testing.T, def, sharp []byte) {
+	t.Helper()
+
+	if bytes.Equal(def, sharp) {
+		t.Error("sharp YUV output is the same as the default")
+	}
+
+	if _, err := Decode(bytes.NewReader(sharp)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEncodeOptionsChromaDownsampling(t *testing.T) {
+	o := encodeOptions([]Options{{ChromaDownsampling: ChromaDownsamplingAverage, SharpYUV: true}})
+	if o.ChromaDownsampling != ChromaDownsamplingSharpYUV {
+		t.Errorf("got %d, want %d", o.ChromaDownsampling, ChromaDownsamplingSharpYUV)
+	}
+
+	if err := Encode(io.Discard, image.NewRGBA(image.Rect(0, 0, 8, 8)), Options{ChromaDownsampling: 5}); err == nil {
+		t.Error("expected error for an unknown filter")
+	}
+}
+
+func TestEncodeScale(t *testing.T) {
+	skipLegacy(t)
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var full, half bytes.Buffer
+	if err := encode(&full, []image.Image{img}, []uint64{1}, encodeOptions(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := encode(&half, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Scale: Fraction{1, 2}}})); err != nil {
+		t.Fatal(err)
+	}
+
+	testScale(t, full.Bytes(), half.Bytes())
+}
+
+func TestEncodeScaleDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var full, half bytes.Buffer
+	if err := encodeDynamic(&full, []image.Image{img}, []uint64{1}, encodeOptions(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := encodeDynamic(&half, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Scale: Fraction{1, 2}}})); err != nil {
+		t.Fatal(err)
+	}
+
+	testScale(t, full.Bytes(), half.Bytes())
+}
+
+func testScale(t *testing.T, full, half []byte) {
+	t.Helper()
+
+	if len(half) >= len(full) {
+		t.Errorf("got %d bytes at half scale, want fewer than %d", len(half), len(full))
+	}
+
+	img, err := Decode(bytes.NewReader(half))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 512 || b.Dy() != 512 {
+		t.Errorf("got %dx%d, want the 512x512 source size", b.Dx(), b.Dy())
+	}
+}
+
+func TestEncodeOptionsScale(t *testing.T) {
+	if o := encodeOptions([]Options{{Quality: 50}}); o.Scale != (Fraction{1, 1}) {
+		t.Errorf("got scale %v, want 1/1", o.Scale)
+	}
+
+	for _, f := range []Fraction{{0, 2}, {3, 2}, {-1, 2}} {
+		if err := Encode(io.Discard, image.NewRGBA(image.Rect(0, 0, 8, 8)), Options{Scale: f}); err == nil {
+			t.Errorf("%v: expected error", f)
+		}
+	}
+}
+
+func TestEncodeFilmGrain(t *testing.T) {
+	skipLegacy(t)
+
+	img := testGrainSource()
+
+	var plain, grain bytes.Buffer
+	if err := encode(&plain, []image.Image{img}, []uint64{1}, encodeOptions(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := encode(&grain, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{FilmGrain: true}})); err != nil {
+		t.Fatal(err)
+	}
+
+	testFilmGrain(t, plain.Bytes(), grain.Bytes())
+}
+
+func TestEncodeFilmGrainDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	skipLegacy(t)
+
+	img := testGrainSource()
+
+	var plain, grain bytes.Buffer
+	if err := encodeDynamic(&plain, []image.Image{img}, []uint64{1}, encodeOptions(nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := encodeDynamic(&grain, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{FilmGrain: true}})); err != nil {
+		t.Fatal(err)
+	}
+
+	testFilmGrain(t, plain.Bytes(), grain.Bytes())
+}
+
+// testGrainSource returns a mid gray image with pseudo-random noise.
+func testGrainSource() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 128, 128))
+
+	seed := uint32(1)
+	for i := range img.Pix {
+		if i%4 == 3 {
+			img.Pix[i] = 0xff
+			continue
+		}
+
+		seed = seed*1664525 + 1013904223
+		img.Pix[i] = uint8(96 + seed>>26)
+	}
+
+	return img
+}
+
+func testFilmGrain(t *testing.T, plain, grain []byte) {
+	t.Helper()
+
+	if len(grain) >= len(plain) {
+		t.Errorf("got %d bytes with film grain, want fewer than %d", len(grain), len(plain))
+	}
+
+	// Both go through the module so only IgnoreFilmGrain differs, the dynamic backend cannot skip the grain.
+	withGrain, _, err := decode(bytes.NewReader(grain), false, false, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clean, _, err := decode(bytes.NewReader(grain), false, false, Options{IgnoreFilmGrain: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(withGrain.Image[0].(*image.RGBA).Pix, clean.Image[0].(*image.RGBA).Pix) {
+		t.Error("expected the synthesized grain to be skipped")
+	}
+}
+
+func TestEncodeOptionsFilmGrain(t *testing.T) {
+	if o := encodeOptions([]Options{{FilmGrain: true}}); o.CodecOptions["color:denoise-noise-level"] != "25" {
+		t.Errorf("got codec options %v", o.CodecOptions)
+	}
+
+	if o := encodeOptions([]Options{{DenoiseLevel: 80}}); o.CodecOptions["color:denoise-noise-level"] != "50" {
+		t.Errorf("got codec options %v", o.CodecOptions)
+	}
+
+	codec := map[string]string{"denoise-noise-level": "10"}
+	o := encodeOptions([]Options{{DenoiseLevel: 30, CodecOptions: codec}})
+	if len(o.CodecOptions) != 1 || o.CodecOptions["denoise-noise-level"] != "10" {
+		t.Errorf("got codec options %v", o.CodecOptions)
+	}
+
+	codec = map[string]string{"tune": "ssim"}
+	encodeOptions([]Options{{FilmGrain: true, CodecOptions: codec}})
+	if len(codec) != 1 {
+		t.Errorf("caller codec options modified: %v", codec)
+	}
+
+	if o := encodeOptions([]Options{{FilmGrain: true, Lossless: true}}); o.CodecOptions != nil || o.FilmGrain {
+		t.Errorf("got film grain with lossless: %v", o.CodecOptions)
+	}
+}
+
+func TestCodec(t *testing.T) {
+	cases := []struct {
+		codec  int
+		encode bool
+		ok     bool
+	}{
+		{CodecAuto, true, true},
+		{CodecAuto, false, true},
+		{CodecAOM, true, true},
+		{CodecAOM, false, false},
+		{CodecDav1d, false, true},
+		{CodecDav1d, true, false},
+		{CodecLibgav1, false, false},
+		{CodecRav1e, true, false},
+		{CodecSVT, true, false},
+		{len(codecNames), true, false},
+		{-1, false, false},
+	}
+
+	for _, c := range cases {
+		if err := checkCodec(c.codec, c.encode); (err == nil) != c.ok {
+			t.Errorf("codec %d, encode %v: got %v", c.codec, c.encode, err)
+		}
+	}
+
+	if dynamic {
+		return
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	if err := Encode(io.Discard, img, Options{Codec: CodecRav1e}); err == nil || !strings.Contains(err.Error(), "rav1e") {
+		t.Errorf("got %v, want rav1e error", err)
+	}
+
+	if _, err := Decode(bytes.NewReader(testAvif8), Options{Codec: CodecLibgav1}); err == nil {
+		t.Error("expected error for libgav1")
+	}
+}
+
+func TestEncodeCodecDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+
+	for _, codec := range []int{CodecAOM, CodecRav1e, CodecSVT} {
+		var b bytes.Buffer
+		err := encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Codec: codec}}))
+
+		if checkDynamicCodec(codec, avifCodecFlagCanEncode) != nil {
+			if err == nil {
+				t.Errorf("%s: expected error for a missing codec", codecNames[codec])
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", codecNames[codec], err)
+			continue
+		}
+
+		if _, _, err := decodeDynamic(bytes.NewReader(b.Bytes()), false, false, Options{}); err != nil {
+			t.Errorf("%s: %v", codecNames[codec], err)
+		}
+	}
+
+	for _, codec := range []int{CodecAOM, CodecDav1d, CodecLibgav1} {
+		_, _, err := decodeDynamic(bytes.NewReader(testAvif8), false, false, Options{Codec: codec})
+		if (err == nil) != (checkDynamicCodec(codec, avifCodecFlagCanDecode) == nil) {
+			t.Errorf("%s: got %v", codecNames[codec], err)
+		}
+	}
+
+	_, err := Decode(bytes.NewReader(testAvif8), Options{IgnoreFilmGrain: true, Codec: CodecLibgav1})
+	if err == nil || !strings.Contains(err.Error(), "IgnoreFilmGrain") {
+		t.Errorf("got %v, want an IgnoreFilmGrain error", err)
+	}
+}
+
+func TestEncodeStats(t *testing.T) {
+	skipLegacy(t)
+
+	var stats Stats
+
+	var b bytes.Buffer
+	err := encode(&b, []image.Image{testStatsSource()}, []uint64{1}, encodeOptions([]Options{{Stats: &stats}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStats(t, stats, backend, b.Len())
+
+	stats = Stats{}
+	if _, _, err := decode(bytes.NewReader(b.Bytes()), false, false, Options{Stats: &stats}); err != nil {
+		t.Fatal(err)
+	}
+
+	testStats(t, stats, backend, b.Len())
+}
+
+func TestEncodeStatsDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	var stats Stats
+
+	var b bytes.Buffer
+	err := encodeDynamic(&b, []image.Image{testStatsSource()}, []uint64{1}, encodeOptions([]Options{{Stats: &stats}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStats(t, stats, "dynamic", b.Len())
+
+	stats = Stats{}
+	if _, _, err := decodeDynamic(bytes.NewReader(b.Bytes()), false, false, Options{Stats: &stats}); err != nil {
+		t.Fatal(err)
+	}
+
+	testStats(t, stats, "dynamic", b.Len())
+}
+
+// testStatsSource returns a gradient with a translucent half, so both color and alpha are coded.
+func testStatsSource() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			a := uint8(0xff)
+			if x >= 32 {
+				a = 0x80
+			}
+
+			img.SetNRGBA(x, y, color.NRGBA{R: uint8(x * 4), G: uint8(y * 4), B: 0x40, A: a})
+		}
+	}
+
+	return img
+}
+
+func testStats(t *testing.T, stats Stats, backend string, size int) {
+	t.Helper()
+
+	if stats.Backend != backend || stats.Frames != 1 {
+		t.Errorf("got backend %q, %d frames", stats.Backend, stats.Frames)
+	}
+
+	if stats.ColorSize <= 0 || stats.AlphaSize <= 0 || stats.ColorSize+stats.AlphaSize > size {
+		t.Errorf("got color %d and alpha %d bytes in a %d byte file", stats.ColorSize, stats.AlphaSize, size)
+	}
+
+	if stats.Convert < 0 || stats.Codec <= 0 {
+		t.Errorf("got conversion %v, coding %v", stats.Convert, stats.Codec)
+	}
+}
+
+func TestWasmStats(t *testing.T) {
+	got := wasmStats("wazero", 2, [wasmStatsSize]uint64{100, 20, 3000, 40000})
+	want := Stats{Backend: "wazero", ColorSize: 100, AlphaSize: 20, Frames: 2, Convert: 3 * time.Microsecond, Codec: 40 * time.Microsecond}
+
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestEncodeAll(t *testing.T) {
+	skipLegacy(t)
+
+	ret, _, err := decode(bytes.NewReader(testAvifAnim), false, true, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := encodeOptions([]Options{{Speed: DefaultSpeed, Timescale: 90, LoopCount: -1}})
+
+	var b bytes.Buffer
+	err = encode(&b, ret.Image, frameDurations(ret.Delay, opts.Timescale), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	anim, _, err := decode(bytes.NewReader(b.Bytes()), false, true, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDelays(t, ret.Delay, anim, opts.Timescale)
+}
+
+func TestEncodeAllDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	ret, _, err := decodeDynamic(bytes.NewReader(testAvifAnim), false, true, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := encodeOptions([]Options{{Speed: DefaultSpeed, Timescale: 90, LoopCount: -1}})
+
+	var b bytes.Buffer
+	err = encodeDynamic(&b, ret.Image, frameDurations(ret.Delay, opts.Timescale), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	anim, _, err := decodeDynamic(bytes.NewReader(b.Bytes()), false, true, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testDelays(t, ret.Delay, anim, opts.Timescale)
+}
+
+// testDelays checks that anim has a frame for every delay in want, each within half a timescale unit of it.
+func testDelays(t *testing.T, want []float64, anim *AVIF, timescale int) {
+	t.Helper()
+
+	if len(anim.Image) != len(want) || len(anim.Delay) != len(want) {
+		t.Fatalf("got %d images and %d delays, want %d", len(anim.Image), len(anim.Delay), len(want))
+	}
+
+	for i, d := range anim.Delay {
+		if math.Abs(d-want[i]) > 0.5/float64(timescale)+1e-9 {
+			t.Errorf("delay %d: got %f, want %f", i, d, want[i])
+		}
+	}
+}
+
+func TestEncodeAllMismatch(t *testing.T) {
+	a := &AVIF{Image: []image.Image{image.NewRGBA(image.Rect(0, 0, 8, 8))}}
+
+	err := EncodeAll(io.Discard, a)
+	if err == nil {
+		t.Error("expected error for missing delay")
+	}
+
+	if err := EncodeAll(io.Discard, nil); err == nil {
+		t.Error("expected error for a nil AVIF")
+	}
+}
+
 func TestEncodeSync(t *testing.T) {
 	wg := sync.WaitGroup{}
 	ch := make(chan bool, 2)
@@ -279,7 +1898,7 @@ func TestEncodeSync(t *testing.T) {
 			ch <- true
 			defer func() { <-ch; wg.Done() }()
 
-			err = encode(io.Discard, img, DefaultQuality, DefaultQuality, DefaultSpeed, image.YCbCrSubsampleRatio420, false)
+			err = encode(io.Discard, []image.Image{img}, []uint64{1}, encodeOptions(nil))
 			if err != nil {
 				t.Error(err)
 			}
@@ -289,9 +1908,18 @@ func TestEncodeSync(t *testing.T) {
 	wg.Wait()
 }
 
+// skipLegacy skips tests of options the embedded WASM module is too old to encode or decode.
+func skipLegacy(t *testing.T) {
+	t.Helper()
+
+	if legacyModule() {
+		t.Skip("lib/avif.wasm predates the extended exports, rebuild it with make in lib/")
+	}
+}
+
 func BenchmarkDecode(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		_, _, err := decode(bytes.NewReader(testAvif8), false, false)
+		_, _, err := decode(bytes.NewReader(testAvif8), false, false, Options{})
 		if err != nil {
 			b.Error(err)
 		}
@@ -305,7 +1933,7 @@ func BenchmarkDecodeDynamic(b *testing.B) {
 	}
 
 	for i := 0; i < b.N; i++ {
-		_, _, err := decodeDynamic(bytes.NewReader(testAvif8), false, false)
+		_, _, err := decodeDynamic(bytes.NewReader(testAvif8), false, false, Options{})
 		if err != nil {
 			b.Error(err)
 		}
@@ -314,7 +1942,7 @@ func BenchmarkDecodeDynamic(b *testing.B) {
 
 func BenchmarkDecodeConfig(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		_, _, err := decode(bytes.NewReader(testAvif8), true, false)
+		_, _, err := decode(bytes.NewReader(testAvif8), true, false, Options{})
 		if err != nil {
 			b.Error(err)
 		}
@@ -328,7 +1956,7 @@ func BenchmarkDecodeConfigDynamic(b *testing.B) {
 	}
 
 	for i := 0; i < b.N; i++ {
-		_, _, err := decodeDynamic(bytes.NewReader(testAvif8), true, false)
+		_, _, err := decodeDynamic(bytes.NewReader(testAvif8), true, false, Options{})
 		if err != nil {
 			b.Error(err)
 		}
@@ -342,7 +1970,7 @@ func BenchmarkEncode(b *testing.B) {
 	}
 
 	for i := 0; i < b.N; i++ {
-		err := encode(io.Discard, img, DefaultQuality, DefaultQuality, DefaultSpeed, image.YCbCrSubsampleRatio420, false)
+		err := encode(io.Discard, []image.Image{img}, []uint64{1}, encodeOptions(nil))
 		if err != nil {
 			b.Error(err)
 		}
@@ -361,13 +1989,37 @@ func BenchmarkEncodeDynamic(b *testing.B) {
 	}
 
 	for i := 0; i < b.N; i++ {
-		err := encodeDynamic(io.Discard, img, DefaultQuality, DefaultQuality, DefaultSpeed, image.YCbCrSubsampleRatio420, false)
+		err := encodeDynamic(io.Discard, []image.Image{img}, []uint64{1}, encodeOptions(nil))
 		if err != nil {
 			b.Error(err)
 		}
 	}
 }
 
+func testYCbCr(ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	img := image.NewYCbCr(image.Rect(0, 0, 67, 33), ratio)
+
+	for i := range img.Y {
+		img.Y[i] = uint8(i)
+	}
+
+	for i := range img.Cb {
+		img.Cb[i] = uint8(i * 3)
+		img.Cr[i] = uint8(255 - i)
+	}
+
+	return img
+}
+
+// testICC returns a placeholder ICC profile; libavif stores it without validation.
+func testICC() []byte {
+	icc := make([]byte, 132)
+	copy(icc[36:], "acsp")
+	copy(icc[48:], "avif-test")
+
+	return icc
+}
+
 type discard struct{}
 
 func (d discard) Close() error {
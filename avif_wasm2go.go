@@ -7,14 +7,14 @@ import (
 	"encoding/binary"
 	"fmt"
 	"image"
-	"image/color"
 	"io"
 	"math"
 	"os"
+	"time"
 	"unsafe"
 )
 
-func decode(r io.Reader, configOnly, decodeAll bool) (ret *AVIF, cfg image.Config, err error) {
+func decode(r io.Reader, configOnly, decodeAll bool, o Options) (ret *AVIF, cfg image.Config, err error) {
 	mod := newModule()
 
 	defer func() {
@@ -42,15 +42,16 @@ func decode(r io.Reader, configOnly, decodeAll bool) (ret *AVIF, cfg image.Confi
 		return nil, cfg, ErrMemWrite
 	}
 
-	ptr := mod.Xmalloc(4 * 4)
+	ptr := mod.Xmalloc(5 * 4)
 	defer mod.Xfree(ptr)
 
 	widthPtr := ptr
 	heightPtr := ptr + 4
 	depthPtr := ptr + 8
-	countPtr := ptr + 12
+	grayPtr := ptr + 12
+	countPtr := ptr + 16
 
-	res := mod.Xdecode(inPtr, int32(inSize), 1, 0, widthPtr, heightPtr, depthPtr, countPtr, 0, 0)
+	res := mod.Xdecode(inPtr, int32(inSize), 1, 0, 0, 0, widthPtr, heightPtr, depthPtr, grayPtr, countPtr, 0, 0, 0)
 	if res == 0 {
 		return nil, cfg, ErrDecode
 	}
@@ -70,6 +71,11 @@ func decode(r io.Reader, configOnly, decodeAll bool) (ret *AVIF, cfg image.Confi
 		return nil, cfg, ErrMemRead
 	}
 
+	gray, ok := mod.readUint32(grayPtr)
+	if !ok {
+		return nil, cfg, ErrMemRead
+	}
+
 	count, ok := mod.readUint32(countPtr)
 	if !ok {
 		return nil, cfg, ErrMemRead
@@ -78,10 +84,7 @@ func decode(r io.Reader, configOnly, decodeAll bool) (ret *AVIF, cfg image.Confi
 	cfg.Width = int(width)
 	cfg.Height = int(height)
 
-	cfg.ColorModel = color.RGBAModel
-	if depth > 8 {
-		cfg.ColorModel = color.RGBA64Model
-	}
+	cfg.ColorModel = colorModel(depth > 8, gray != 0, o.StraightAlpha)
 
 	if configOnly {
 		return nil, cfg, nil
@@ -108,12 +111,25 @@ func decode(r io.Reader, configOnly, decodeAll bool) (ret *AVIF, cfg image.Confi
 	delayPtr := mod.Xmalloc(int32(delaySize))
 	defer mod.Xfree(delayPtr)
 
+	statsPtr := mod.Xmalloc(8 * wasmStatsSize)
+	defer mod.Xfree(statsPtr)
+
 	all := int32(0)
 	if decodeAll {
 		all = 1
 	}
 
-	res = mod.Xdecode(inPtr, int32(inSize), 0, all, widthPtr, heightPtr, depthPtr, countPtr, delayPtr, outPtr)
+	straightAlpha := int32(0)
+	if o.StraightAlpha {
+		straightAlpha = 1
+	}
+
+	ignoreGrain := int32(0)
+	if o.IgnoreFilmGrain {
+		ignoreGrain = 1
+	}
+
+	res = mod.Xdecode(inPtr, int32(inSize), 0, all, straightAlpha, ignoreGrain, widthPtr, heightPtr, depthPtr, grayPtr, countPtr, delayPtr, outPtr, statsPtr)
 	if res == 0 {
 		return nil, cfg, ErrDecode
 	}
@@ -136,13 +152,9 @@ func decode(r io.Reader, configOnly, decodeAll bool) (ret *AVIF, cfg image.Confi
 				return nil, cfg, nil
 			}
 
-			img := image.NewRGBA64(image.Rect(0, 0, cfg.Width, cfg.Height))
-			img.Pix = b.Bytes()
-			images = append(images, img)
+			images = append(images, newImage(b.Bytes(), cfg.Width, cfg.Height, true, o.StraightAlpha))
 		} else {
-			img := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
-			img.Pix = out
-			images = append(images, img)
+			images = append(images, newImage(out, cfg.Width, cfg.Height, false, o.StraightAlpha))
 		}
 
 		d, ok := mod.readFloat64(delayPtr + int32(i*8))
@@ -157,6 +169,15 @@ func decode(r io.Reader, configOnly, decodeAll bool) (ret *AVIF, cfg image.Confi
 		}
 	}
 
+	if o.Stats != nil {
+		stats, ok := mod.readStats(statsPtr)
+		if !ok {
+			return nil, cfg, ErrMemRead
+		}
+
+		*o.Stats = wasmStats(backend, len(images), stats)
+	}
+
 	ret = &AVIF{
 		Image: images,
 		Delay: delay,
@@ -165,7 +186,13 @@ func decode(r io.Reader, configOnly, decodeAll bool) (ret *AVIF, cfg image.Confi
 	return ret, cfg, nil
 }
 
-func encode(w io.Writer, m image.Image, quality, qualityAlpha, speed int, subsampleRatio image.YCbCrSubsampleRatio, lossless bool) (err error) {
+func encode(w io.Writer, images []image.Image, durations []uint64, o Options) error {
+	_, err := encodeToSize(w, images, durations, o, 0)
+
+	return err
+}
+
+func encodeToSize(w io.Writer, images []image.Image, durations []uint64, o Options, maxBytes int) (quality int, err error) {
 	mod := newModule()
 
 	defer func() {
@@ -178,61 +205,187 @@ func encode(w io.Writer, m image.Image, quality, qualityAlpha, speed int, subsam
 		}
 	}()
 
-	img := imageToRGBA(m)
-
-	var chroma int
-	switch subsampleRatio {
-	case image.YCbCrSubsampleRatio444:
-		chroma = avifPixelFormatYuv444
-	case image.YCbCrSubsampleRatio422:
-		chroma = avifPixelFormatYuv422
-	case image.YCbCrSubsampleRatio420:
-		chroma = avifPixelFormatYuv420
-	default:
-		return fmt.Errorf("unsupported chroma %d", subsampleRatio)
+	in, err := newEncodeInput(images, o)
+	if err != nil {
+		return 0, err
 	}
 
-	inPtr := mod.Xmalloc(int32(len(img.Pix)))
+	frameSize := in.frameSize()
+
+	inPtr := mod.Xmalloc(int32(frameSize * len(images)))
 	defer mod.Xfree(inPtr)
 
-	ok := mod.write(inPtr, img.Pix)
-	if !ok {
-		return ErrMemWrite
+	for i, m := range images {
+		ok := mod.write(inPtr+int32(i*frameSize), in.pix(m))
+		if !ok {
+			return 0, ErrMemWrite
+		}
+	}
+
+	durationsPtr := mod.Xmalloc(int32(8 * len(durations)))
+	defer mod.Xfree(durationsPtr)
+
+	for i, d := range durations {
+		ok := mod.writeUint64(durationsPtr+int32(i*8), d)
+		if !ok {
+			return 0, ErrMemWrite
+		}
 	}
 
 	sizePtr := mod.Xmalloc(8)
 	defer mod.Xfree(sizePtr)
 
-	ll := int32(0)
-	if lossless {
-		ll = 1
+	qualityPtr := mod.Xmalloc(4)
+	defer mod.Xfree(qualityPtr)
+
+	statsPtr := mod.Xmalloc(8 * wasmStatsSize)
+	defer mod.Xfree(statsPtr)
+
+	iccPtr, ok := mod.writeBytes(o.ICC)
+	if !ok {
+		return 0, ErrMemWrite
+	}
+	defer mod.Xfree(iccPtr)
+
+	exifPtr, ok := mod.writeBytes(o.Exif)
+	if !ok {
+		return 0, ErrMemWrite
 	}
+	defer mod.Xfree(exifPtr)
 
-	outPtr := mod.Xencode(inPtr, int32(img.Bounds().Dx()), int32(img.Bounds().Dy()), sizePtr, int32(quality),
-		int32(qualityAlpha), int32(speed), int32(chroma), ll)
+	xmpPtr, ok := mod.writeBytes(o.XMP)
+	if !ok {
+		return 0, ErrMemWrite
+	}
+	defer mod.Xfree(xmpPtr)
+
+	csOptionsPtr, ok := mod.writeBytes(codecOptions(o.CodecOptions))
+	if !ok {
+		return 0, ErrMemWrite
+	}
+	defer mod.Xfree(csOptionsPtr)
+
+	layersPtr, ok := mod.writeBytes(layerParams(o.Layers))
+	if !ok {
+		return 0, ErrMemWrite
+	}
+	defer mod.Xfree(layersPtr)
+
+	clapPtr, ok := mod.writeBytes(clapParams(in.crop, in.width, in.height))
+	if !ok {
+		return 0, ErrMemWrite
+	}
+	defer mod.Xfree(clapPtr)
+
+	diagPtr := mod.Xmalloc(avifDiagnosticsErrorBufferSize)
+	defer mod.Xfree(diagPtr)
+
+	yuv := int32(0)
+	if in.yuv {
+		yuv = 1
+	}
+
+	alpha := int32(0)
+	if in.alpha {
+		alpha = 1
+	}
+
+	transform, angle, axis := -1, 0, 0
+	if o.Orientation > 0 {
+		transform, angle, axis = irotImirFromExifOrientation(o.Orientation)
+	}
+
+	autoTiling := int32(0)
+	if o.AutoTiling {
+		autoTiling = 1
+	}
+
+	c := colorDescription(in, o)
+
+	fullRange := int32(0)
+	if c.FullRange {
+		fullRange = 1
+	}
+
+	straight := int32(0)
+	if in.straight {
+		straight = 1
+	}
+
+	premultiplied := int32(0)
+	if in.premultiplied {
+		premultiplied = 1
+	}
+
+	ignoreAlpha := int32(0)
+	if in.ignoreAlpha {
+		ignoreAlpha = 1
+	}
+
+	headerFormat := int32(avifHeaderDefault)
+	if o.CompactHeader {
+		headerFormat = avifHeaderMini
+	}
+
+	outPtr := mod.Xencode(inPtr, yuv, alpha, int32(in.width), int32(in.height), int32(in.depth), int32(len(images)),
+		durationsPtr, sizePtr, int32(o.Quality), int32(o.QualityAlpha), int32(o.Speed), int32(in.format),
+		int64(o.Timescale), int32(o.KeyframeInterval), int32(repetitionCount(o.LoopCount)),
+		iccPtr, int32(len(o.ICC)), exifPtr, int32(len(o.Exif)), xmpPtr, int32(len(o.XMP)),
+		int32(transform), int32(angle), int32(axis),
+		int32(c.ColorPrimaries), int32(c.TransferCharacteristics), int32(c.MatrixCoefficients), fullRange,
+		int32(o.MaxCLL), int32(o.MaxPALL),
+		int32(o.TileRows), int32(o.TileCols), autoTiling,
+		int32(o.MinQuantizer), int32(o.MaxQuantizer), int32(o.MinQuantizerAlpha), int32(o.MaxQuantizerAlpha),
+		csOptionsPtr, int32(len(o.CodecOptions)), layersPtr, int32(len(o.Layers)),
+		int32(in.gridCols), int32(in.gridRows), straight, premultiplied, ignoreAlpha, headerFormat,
+		clapPtr, int32(o.PixelAspect.N), int32(o.PixelAspect.D), int32(o.ChromaDownsampling),
+		int32(o.Scale.N), int32(o.Scale.D), int32(maxBytes), qualityPtr, statsPtr, diagPtr)
 
 	size, ok := mod.readUint64(sizePtr)
 	if !ok {
-		return ErrMemRead
+		return 0, ErrMemRead
 	}
 
 	if size == 0 {
-		return ErrEncode
+		diag, ok := mod.read(diagPtr, avifDiagnosticsErrorBufferSize)
+		if !ok {
+			return 0, ErrMemRead
+		}
+
+		return 0, encodeError(diag)
 	}
 
 	defer mod.Xfree(outPtr)
 
+	if maxBytes > 0 && size > uint64(maxBytes) {
+		return 0, fmt.Errorf("%w: smallest output is %d bytes", ErrTargetSize, size)
+	}
+
+	q, ok := mod.readUint32(qualityPtr)
+	if !ok {
+		return 0, ErrMemRead
+	}
+
 	out, ok := mod.read(outPtr, int32(size))
 	if !ok {
-		return ErrMemRead
+		return 0, ErrMemRead
+	}
+
+	if o.Stats != nil {
+		stats, ok := mod.readStats(statsPtr)
+		if !ok {
+			return 0, ErrMemRead
+		}
+
+		*o.Stats = wasmStats(backend, len(images), stats)
 	}
 
 	_, err = w.Write(out)
 	if err != nil {
-		return fmt.Errorf("write: %w", err)
+		return 0, fmt.Errorf("write: %w", err)
 	}
 
-	return nil
+	return int(int32(q)), nil
 }
 
 func newModule() *module {
@@ -252,6 +405,27 @@ func (m *module) write(ptr int32, data []byte) bool {
 	return true
 }
 
+// writeBytes copies data into newly allocated memory, returning a null pointer for empty data.
+func (m *module) writeBytes(data []byte) (int32, bool) {
+	if len(data) == 0 {
+		return 0, true
+	}
+
+	ptr := m.Xmalloc(int32(len(data)))
+
+	return ptr, m.write(ptr, data)
+}
+
+func (m *module) writeUint64(ptr int32, v uint64) bool {
+	if ptr < 0 || int(ptr)+8 > len(m.memory) {
+		return false
+	}
+
+	store64(m.memory[ptr:], v)
+
+	return true
+}
+
 func (m *module) read(ptr, size int32) ([]byte, bool) {
 	if ptr < 0 || size < 0 || int(ptr)+int(size) > len(m.memory) {
 		return nil, false
@@ -276,6 +450,21 @@ func (m *module) readUint64(ptr int32) (uint64, bool) {
 	return load64(m.memory[ptr:]), true
 }
 
+// readStats reads the statistics the module wrote at ptr.
+func (m *module) readStats(ptr int32) ([wasmStatsSize]uint64, bool) {
+	var stats [wasmStatsSize]uint64
+	for i := range stats {
+		v, ok := m.readUint64(ptr + int32(i*8))
+		if !ok {
+			return stats, false
+		}
+
+		stats[i] = v
+	}
+
+	return stats, true
+}
+
 func (m *module) readFloat64(ptr int32) (float64, bool) {
 	v, ok := m.readUint64(ptr)
 	if !ok {
@@ -291,6 +480,21 @@ type procExit struct {
 	code int32
 }
 
+// clockMonotonic is the wasi monotonic clock id.
+const clockMonotonic = 1
+
+// clockStart is the origin of the monotonic clock.
+var clockStart = time.Now()
+
+// backend is reported in Stats.Backend.
+const backend = "wasm2go"
+
+// legacyModule reports whether the module predates the extended encode and decode exports, never for wasm2go,
+// which is generated from the current lib/avif.c.
+func legacyModule() bool {
+	return false
+}
+
 // errBadf is the wasi EBADF errno, returned from the unused file-I/O imports.
 const errBadf = 8
 
@@ -305,8 +509,15 @@ func (h *wasiHost) Init(m any) {
 	h.mod = m.(*module)
 }
 
+// Xclock_time_get reports the monotonic clock used for Stats as the time since the package was loaded,
+// the other clocks read as 0.
 func (h *wasiHost) Xclock_time_get(id int32, precision int64, retPtr int32) int32 {
-	store64(h.mod.memory[retPtr:], 0)
+	var t int64
+	if id == clockMonotonic {
+		t = int64(time.Since(clockStart))
+	}
+
+	store64(h.mod.memory[retPtr:], uint64(t))
 	return 0
 }
 
@@ -9,12 +9,13 @@ import (
 	"debug/pe"
 	_ "embed"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"image"
-	"image/color"
 	"io"
 	"math"
 	"os"
+	"reflect"
 	"runtime"
 	"sync"
 
@@ -24,10 +25,13 @@ import (
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 )
 
+// backend is reported in Stats.Backend.
+const backend = "wazero"
+
 //go:embed lib/avif.wasm.gz
 var avifWasm []byte
 
-func decode(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config, error) {
+func decode(r io.Reader, configOnly, decodeAll bool, o Options) (*AVIF, image.Config, error) {
 	initOnce()
 
 	var cfg image.Config
@@ -44,6 +48,10 @@ func decode(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config, error
 	_free := mod.ExportedFunction("free")
 	_decode := mod.ExportedFunction("decode")
 
+	if legacyABI && (o.StraightAlpha || o.IgnoreFilmGrain || o.Stats != nil) {
+		return nil, cfg, errLegacyModule
+	}
+
 	data, err := io.ReadAll(r)
 	if err != nil {
 		return nil, cfg, fmt.Errorf("read: %w", err)
@@ -63,7 +71,7 @@ func decode(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config, error
 		return nil, cfg, ErrMemWrite
 	}
 
-	res, err = _alloc.Call(ctx, 4*4)
+	res, err = _alloc.Call(ctx, 5*4)
 	if err != nil {
 		return nil, cfg, fmt.Errorf("alloc: %w", err)
 	}
@@ -72,9 +80,14 @@ func decode(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config, error
 	widthPtr := res[0]
 	heightPtr := res[0] + 4
 	depthPtr := res[0] + 8
-	countPtr := res[0] + 12
+	grayPtr := res[0] + 12
+	countPtr := res[0] + 16
 
-	res, err = _decode.Call(ctx, inPtr, uint64(inSize), 1, 0, widthPtr, heightPtr, depthPtr, countPtr, 0, 0)
+	if legacyABI {
+		res, err = _decode.Call(ctx, inPtr, uint64(inSize), 1, 0, widthPtr, heightPtr, depthPtr, countPtr, 0, 0)
+	} else {
+		res, err = _decode.Call(ctx, inPtr, uint64(inSize), 1, 0, 0, 0, widthPtr, heightPtr, depthPtr, grayPtr, countPtr, 0, 0, 0)
+	}
 	if err != nil {
 		return nil, cfg, fmt.Errorf("decode: %w", err)
 	}
@@ -98,6 +111,14 @@ func decode(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config, error
 		return nil, cfg, ErrMemRead
 	}
 
+	gray := uint32(0)
+	if !legacyABI {
+		gray, ok = mod.Memory().ReadUint32Le(uint32(grayPtr))
+		if !ok {
+			return nil, cfg, ErrMemRead
+		}
+	}
+
 	count, ok := mod.Memory().ReadUint32Le(uint32(countPtr))
 	if !ok {
 		return nil, cfg, ErrMemRead
@@ -106,10 +127,7 @@ func decode(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config, error
 	cfg.Width = int(width)
 	cfg.Height = int(height)
 
-	cfg.ColorModel = color.RGBAModel
-	if depth > 8 {
-		cfg.ColorModel = color.RGBA64Model
-	}
+	cfg.ColorModel = colorModel(depth > 8, gray != 0, o.StraightAlpha)
 
 	if configOnly {
 		return nil, cfg, nil
@@ -144,12 +162,33 @@ func decode(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config, error
 	delayPtr := res[0]
 	defer _free.Call(ctx, delayPtr)
 
+	res, err = _alloc.Call(ctx, 8*wasmStatsSize)
+	if err != nil {
+		return nil, cfg, fmt.Errorf("alloc: %w", err)
+	}
+	statsPtr := res[0]
+	defer _free.Call(ctx, statsPtr)
+
 	all := 0
 	if decodeAll {
 		all = 1
 	}
 
-	res, err = _decode.Call(ctx, inPtr, uint64(inSize), 0, uint64(all), widthPtr, heightPtr, depthPtr, countPtr, delayPtr, outPtr)
+	straightAlpha := 0
+	if o.StraightAlpha {
+		straightAlpha = 1
+	}
+
+	ignoreGrain := 0
+	if o.IgnoreFilmGrain {
+		ignoreGrain = 1
+	}
+
+	if legacyABI {
+		res, err = _decode.Call(ctx, inPtr, uint64(inSize), 0, uint64(all), widthPtr, heightPtr, depthPtr, countPtr, delayPtr, outPtr)
+	} else {
+		res, err = _decode.Call(ctx, inPtr, uint64(inSize), 0, uint64(all), uint64(straightAlpha), uint64(ignoreGrain), widthPtr, heightPtr, depthPtr, grayPtr, countPtr, delayPtr, outPtr, statsPtr)
+	}
 	if err != nil {
 		return nil, cfg, fmt.Errorf("decode: %w", err)
 	}
@@ -173,13 +212,9 @@ func decode(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config, error
 				binary.BigEndian.PutUint16(pix[j:], binary.LittleEndian.Uint16(out[j:]))
 			}
 
-			img := image.NewRGBA64(image.Rect(0, 0, cfg.Width, cfg.Height))
-			img.Pix = pix
-			images = append(images, img)
+			images = append(images, newImage(pix, cfg.Width, cfg.Height, true, o.StraightAlpha))
 		} else {
-			img := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
-			img.Pix = out
-			images = append(images, img)
+			images = append(images, newImage(out, cfg.Width, cfg.Height, false, o.StraightAlpha))
 		}
 
 		d, ok := mod.Memory().ReadUint64Le(uint32(delayPtr) + uint32(i*8))
@@ -194,6 +229,15 @@ func decode(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config, error
 		}
 	}
 
+	if o.Stats != nil {
+		stats, err := readStats(mod, statsPtr)
+		if err != nil {
+			return nil, cfg, err
+		}
+
+		*o.Stats = wasmStats(backend, len(images), stats)
+	}
+
 	ret := &AVIF{
 		Image: images,
 		Delay: delay,
@@ -202,13 +246,19 @@ func decode(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config, error
 	return ret, cfg, nil
 }
 
-func encode(w io.Writer, m image.Image, quality, qualityAlpha, speed int, subsampleRatio image.YCbCrSubsampleRatio, lossless bool) error {
+func encode(w io.Writer, images []image.Image, durations []uint64, o Options) error {
+	_, err := encodeToSize(w, images, durations, o, 0)
+
+	return err
+}
+
+func encodeToSize(w io.Writer, images []image.Image, durations []uint64, o Options, maxBytes int) (int, error) {
 	initOnce()
 
 	ctx := context.Background()
 	mod, err := rt.InstantiateModule(ctx, cm, mc)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	defer mod.Close(ctx)
@@ -217,10 +267,230 @@ func encode(w io.Writer, m image.Image, quality, qualityAlpha, speed int, subsam
 	_free := mod.ExportedFunction("free")
 	_encode := mod.ExportedFunction("encode")
 
-	img := imageToRGBA(m)
+	in, err := newEncodeInput(images, o)
+	if err != nil {
+		return 0, err
+	}
+
+	if legacyABI {
+		if len(images) > 1 || in.gridCols*in.gridRows > 1 || maxBytes > 0 || !legacyOptions(o) {
+			return 0, errLegacyModule
+		}
+
+		return 0, encodeLegacy(ctx, mod, w, images[0], o)
+	}
+
+	frameSize := in.frameSize()
+
+	res, err := _alloc.Call(ctx, uint64(frameSize*len(images)))
+	if err != nil {
+		return 0, fmt.Errorf("alloc: %w", err)
+	}
+	inPtr := res[0]
+	defer _free.Call(ctx, inPtr)
+
+	for i, m := range images {
+		ok := mod.Memory().Write(uint32(inPtr)+uint32(i*frameSize), in.pix(m))
+		if !ok {
+			return 0, ErrMemWrite
+		}
+	}
+
+	res, err = _alloc.Call(ctx, uint64(8*len(durations)))
+	if err != nil {
+		return 0, fmt.Errorf("alloc: %w", err)
+	}
+	durationsPtr := res[0]
+	defer _free.Call(ctx, durationsPtr)
+
+	for i, d := range durations {
+		ok := mod.Memory().WriteUint64Le(uint32(durationsPtr)+uint32(i*8), d)
+		if !ok {
+			return 0, ErrMemWrite
+		}
+	}
+
+	res, err = _alloc.Call(ctx, 8)
+	if err != nil {
+		return 0, fmt.Errorf("alloc: %w", err)
+	}
+	sizePtr := res[0]
+	defer _free.Call(ctx, sizePtr)
+
+	res, err = _alloc.Call(ctx, 4)
+	if err != nil {
+		return 0, fmt.Errorf("alloc: %w", err)
+	}
+	qualityPtr := res[0]
+	defer _free.Call(ctx, qualityPtr)
+
+	res, err = _alloc.Call(ctx, 8*wasmStatsSize)
+	if err != nil {
+		return 0, fmt.Errorf("alloc: %w", err)
+	}
+	statsPtr := res[0]
+	defer _free.Call(ctx, statsPtr)
+
+	iccPtr, err := writeBytes(ctx, mod, o.ICC)
+	if err != nil {
+		return 0, err
+	}
+	defer _free.Call(ctx, iccPtr)
+
+	exifPtr, err := writeBytes(ctx, mod, o.Exif)
+	if err != nil {
+		return 0, err
+	}
+	defer _free.Call(ctx, exifPtr)
+
+	xmpPtr, err := writeBytes(ctx, mod, o.XMP)
+	if err != nil {
+		return 0, err
+	}
+	defer _free.Call(ctx, xmpPtr)
+
+	csOptionsPtr, err := writeBytes(ctx, mod, codecOptions(o.CodecOptions))
+	if err != nil {
+		return 0, err
+	}
+	defer _free.Call(ctx, csOptionsPtr)
+
+	layersPtr, err := writeBytes(ctx, mod, layerParams(o.Layers))
+	if err != nil {
+		return 0, err
+	}
+	defer _free.Call(ctx, layersPtr)
+
+	clapPtr, err := writeBytes(ctx, mod, clapParams(in.crop, in.width, in.height))
+	if err != nil {
+		return 0, err
+	}
+	defer _free.Call(ctx, clapPtr)
+
+	res, err = _alloc.Call(ctx, avifDiagnosticsErrorBufferSize)
+	if err != nil {
+		return 0, fmt.Errorf("alloc: %w", err)
+	}
+	diagPtr := res[0]
+	defer _free.Call(ctx, diagPtr)
+
+	yuv := uint64(0)
+	if in.yuv {
+		yuv = 1
+	}
+
+	alpha := uint64(0)
+	if in.alpha {
+		alpha = 1
+	}
+
+	transform, angle, axis := -1, 0, 0
+	if o.Orientation > 0 {
+		transform, angle, axis = irotImirFromExifOrientation(o.Orientation)
+	}
+
+	autoTiling := uint64(0)
+	if o.AutoTiling {
+		autoTiling = 1
+	}
+
+	c := colorDescription(in, o)
+
+	fullRange := uint64(0)
+	if c.FullRange {
+		fullRange = 1
+	}
+
+	straight := uint64(0)
+	if in.straight {
+		straight = 1
+	}
+
+	premultiplied := uint64(0)
+	if in.premultiplied {
+		premultiplied = 1
+	}
+
+	ignoreAlpha := uint64(0)
+	if in.ignoreAlpha {
+		ignoreAlpha = 1
+	}
+
+	headerFormat := uint64(avifHeaderDefault)
+	if o.CompactHeader {
+		headerFormat = avifHeaderMini
+	}
+
+	res, err = _encode.Call(ctx, inPtr, yuv, alpha, uint64(in.width), uint64(in.height), uint64(in.depth), uint64(len(images)),
+		durationsPtr, sizePtr, api.EncodeI32(int32(o.Quality)), api.EncodeI32(int32(o.QualityAlpha)), uint64(o.Speed), uint64(in.format),
+		uint64(o.Timescale), uint64(o.KeyframeInterval), api.EncodeI32(int32(repetitionCount(o.LoopCount))),
+		iccPtr, uint64(len(o.ICC)), exifPtr, uint64(len(o.Exif)), xmpPtr, uint64(len(o.XMP)),
+		api.EncodeI32(int32(transform)), uint64(angle), uint64(axis),
+		uint64(c.ColorPrimaries), uint64(c.TransferCharacteristics), uint64(c.MatrixCoefficients), fullRange,
+		uint64(o.MaxCLL), uint64(o.MaxPALL),
+		uint64(o.TileRows), uint64(o.TileCols), autoTiling,
+		uint64(o.MinQuantizer), uint64(o.MaxQuantizer), uint64(o.MinQuantizerAlpha), uint64(o.MaxQuantizerAlpha),
+		csOptionsPtr, uint64(len(o.CodecOptions)), layersPtr, uint64(len(o.Layers)),
+		uint64(in.gridCols), uint64(in.gridRows), straight, premultiplied, ignoreAlpha, headerFormat,
+		clapPtr, uint64(o.PixelAspect.N), uint64(o.PixelAspect.D), uint64(o.ChromaDownsampling),
+		uint64(o.Scale.N), uint64(o.Scale.D), uint64(maxBytes), qualityPtr, statsPtr, diagPtr)
+	if err != nil {
+		return 0, fmt.Errorf("encode: %w", err)
+	}
+
+	size, ok := mod.Memory().ReadUint64Le(uint32(sizePtr))
+	if !ok {
+		return 0, ErrMemRead
+	}
+
+	if size == 0 {
+		diag, ok := mod.Memory().Read(uint32(diagPtr), avifDiagnosticsErrorBufferSize)
+		if !ok {
+			return 0, ErrMemRead
+		}
+
+		return 0, encodeError(diag)
+	}
+
+	defer _free.Call(ctx, res[0])
+
+	if maxBytes > 0 && size > uint64(maxBytes) {
+		return 0, fmt.Errorf("%w: smallest output is %d bytes", ErrTargetSize, size)
+	}
+
+	quality, ok := mod.Memory().ReadUint32Le(uint32(qualityPtr))
+	if !ok {
+		return 0, ErrMemRead
+	}
+
+	out, ok := mod.Memory().Read(uint32(res[0]), uint32(size))
+	if !ok {
+		return 0, ErrMemRead
+	}
+
+	if o.Stats != nil {
+		stats, err := readStats(mod, statsPtr)
+		if err != nil {
+			return 0, err
+		}
+
+		*o.Stats = wasmStats(backend, len(images), stats)
+	}
+
+	_, err = w.Write(out)
+	if err != nil {
+		return 0, fmt.Errorf("write: %w", err)
+	}
+
+	return int(int32(quality)), nil
+}
+
+// encodeLegacy encodes m as a single 8-bit frame with the original encode export of a legacy module.
+func encodeLegacy(ctx context.Context, mod api.Module, w io.Writer, m image.Image, o Options) error {
+	_free := mod.ExportedFunction("free")
 
 	var chroma int
-	switch subsampleRatio {
+	switch o.ChromaSubsampling {
 	case image.YCbCrSubsampleRatio444:
 		chroma = avifPixelFormatYuv444
 	case image.YCbCrSubsampleRatio422:
@@ -228,35 +498,29 @@ func encode(w io.Writer, m image.Image, quality, qualityAlpha, speed int, subsam
 	case image.YCbCrSubsampleRatio420:
 		chroma = avifPixelFormatYuv420
 	default:
-		return fmt.Errorf("unsupported chroma %d", subsampleRatio)
+		return fmt.Errorf("unsupported chroma %d", o.ChromaSubsampling)
 	}
 
-	res, err := _alloc.Call(ctx, uint64(len(img.Pix)))
+	inPtr, err := writeBytes(ctx, mod, framePix(m, 8, false))
 	if err != nil {
-		return fmt.Errorf("alloc: %w", err)
+		return err
 	}
-	inPtr := res[0]
 	defer _free.Call(ctx, inPtr)
 
-	ok := mod.Memory().Write(uint32(inPtr), img.Pix)
-	if !ok {
-		return ErrMemWrite
-	}
-
-	res, err = _alloc.Call(ctx, 8)
+	res, err := mod.ExportedFunction("malloc").Call(ctx, 8)
 	if err != nil {
 		return fmt.Errorf("alloc: %w", err)
 	}
 	sizePtr := res[0]
 	defer _free.Call(ctx, sizePtr)
 
-	ll := uint64(0)
-	if lossless {
-		ll = 1
+	lossless := uint64(0)
+	if o.Lossless {
+		lossless = 1
 	}
 
-	res, err = _encode.Call(ctx, inPtr, uint64(img.Bounds().Dx()), uint64(img.Bounds().Dy()), sizePtr,
-		uint64(quality), uint64(qualityAlpha), uint64(speed), uint64(chroma), ll)
+	res, err = mod.ExportedFunction("encode").Call(ctx, inPtr, uint64(m.Bounds().Dx()), uint64(m.Bounds().Dy()), sizePtr,
+		uint64(o.Quality), uint64(o.QualityAlpha), uint64(o.Speed), uint64(chroma), lossless)
 	if err != nil {
 		return fmt.Errorf("encode: %w", err)
 	}
@@ -285,6 +549,59 @@ func encode(w io.Writer, m image.Image, quality, qualityAlpha, speed int, subsam
 	return nil
 }
 
+// legacyOptions reports whether o sets no more than the quality, speed, chroma and lossless options a legacy
+// module encodes with.
+func legacyOptions(o Options) bool {
+	return reflect.DeepEqual(o, encodeOptions([]Options{{
+		Quality:           o.Quality,
+		QualityAlpha:      o.QualityAlpha,
+		Speed:             o.Speed,
+		ChromaSubsampling: o.ChromaSubsampling,
+		Lossless:          o.Lossless,
+	}}))
+}
+
+// legacyModule reports whether the embedded module predates the extended encode and decode exports.
+func legacyModule() bool {
+	initOnce()
+
+	return legacyABI
+}
+
+// readStats reads the statistics the module wrote at ptr.
+func readStats(mod api.Module, ptr uint64) ([wasmStatsSize]uint64, error) {
+	var stats [wasmStatsSize]uint64
+	for i := range stats {
+		v, ok := mod.Memory().ReadUint64Le(uint32(ptr) + uint32(i*8))
+		if !ok {
+			return stats, ErrMemRead
+		}
+
+		stats[i] = v
+	}
+
+	return stats, nil
+}
+
+// writeBytes copies b into newly allocated module memory, returning a null pointer for empty b.
+func writeBytes(ctx context.Context, mod api.Module, b []byte) (uint64, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	res, err := mod.ExportedFunction("malloc").Call(ctx, uint64(len(b)))
+	if err != nil {
+		return 0, fmt.Errorf("alloc: %w", err)
+	}
+
+	ok := mod.Memory().Write(uint32(res[0]), b)
+	if !ok {
+		return 0, ErrMemWrite
+	}
+
+	return res[0], nil
+}
+
 var (
 	rt wazero.Runtime
 	cm wazero.CompiledModule
@@ -293,6 +610,16 @@ var (
 	initOnce = sync.OnceFunc(initialize)
 )
 
+// legacyDecodeParams is the parameter count of the decode export in modules built before the extended exports.
+const legacyDecodeParams = 10
+
+// legacyABI is set when the embedded module predates the extended encode and decode exports. Such a module still
+// decodes, and encodes single 8-bit frames with the quality, speed, chroma and lossless options; everything else
+// needs lib/avif.wasm rebuilt with make in lib/.
+var legacyABI bool
+
+var errLegacyModule = errors.New("avif: option not supported by the embedded module, rebuild lib/avif.wasm with make in lib/")
+
 func initialize() {
 	ctx := context.Background()
 
@@ -316,12 +643,14 @@ func initialize() {
 		panic(err)
 	}
 
+	legacyABI = len(cm.ExportedFunctions()["decode"].ParamTypes()) == legacyDecodeParams
+
 	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
 
 	if runtime.GOOS == "windows" && isWindowsGUI() {
-		mc = wazero.NewModuleConfig().WithStderr(io.Discard).WithStdout(io.Discard)
+		mc = wazero.NewModuleConfig().WithStderr(io.Discard).WithStdout(io.Discard).WithSysNanotime()
 	} else {
-		mc = wazero.NewModuleConfig().WithStderr(os.Stderr).WithStdout(os.Stdout)
+		mc = wazero.NewModuleConfig().WithStderr(os.Stderr).WithStdout(os.Stdout).WithSysNanotime()
 	}
 }
 
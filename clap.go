@@ -0,0 +1,113 @@
+package avif
+
+import (
+	"encoding/binary"
+	"fmt"
+	"image"
+)
+
+// cleanAperture returns the clap box values (width, height, horizontal and vertical offset as numerator/denominator
+// pairs) that crop a width x height image to r. The offsets are relative to the image center.
+func cleanAperture(r image.Rectangle, width, height int) [8]int32 {
+	return [8]int32{
+		int32(r.Dx()), 1,
+		int32(r.Dy()), 1,
+		int32(2*r.Min.X + r.Dx() - width), 2,
+		int32(2*r.Min.Y + r.Dy() - height), 2,
+	}
+}
+
+// clapParams packs the clap values of the crop as little-endian int32s, nil without a crop.
+func clapParams(crop image.Rectangle, width, height int) []byte {
+	if crop.Empty() {
+		return nil
+	}
+
+	clap := cleanAperture(crop, width, height)
+
+	b := make([]byte, 0, len(clap)*4)
+	for _, v := range clap {
+		b = binary.LittleEndian.AppendUint32(b, uint32(v))
+	}
+
+	return b
+}
+
+// checkCrop reports a crop window that is not inside the width x height image.
+func checkCrop(crop image.Rectangle, width, height int) error {
+	if crop.Empty() || crop.In(image.Rect(0, 0, width, height)) {
+		return nil
+	}
+
+	return fmt.Errorf("crop %v is outside the %dx%d image", crop, width, height)
+}
+
+// cropRect returns the crop window of a clap property for a width x height image. It fails for
+// fractional or out of bounds windows, which are not applied.
+func cropRect(clap []byte, width, height int) (image.Rectangle, bool) {
+	if len(clap) < 32 {
+		return image.Rectangle{}, false
+	}
+
+	var v [8]int64
+	for i := range v {
+		v[i] = int64(int32(binary.BigEndian.Uint32(clap[i*4:])))
+	}
+
+	if v[1] <= 0 || v[3] <= 0 || v[5] <= 0 || v[7] <= 0 || v[0]%v[1] != 0 || v[2]%v[3] != 0 {
+		return image.Rectangle{}, false
+	}
+
+	if (v[4]*2)%v[5] != 0 || (v[6]*2)%v[7] != 0 {
+		return image.Rectangle{}, false
+	}
+
+	w, h := v[0]/v[1], v[2]/v[3]
+
+	// x = horizOff + (width - w)/2, in halves to keep it exact.
+	x2 := v[4]*2/v[5] + int64(width) - w
+	y2 := v[6]*2/v[7] + int64(height) - h
+	if x2%2 != 0 || y2%2 != 0 {
+		return image.Rectangle{}, false
+	}
+
+	r := image.Rect(int(x2/2), int(y2/2), int(x2/2+w), int(y2/2+h))
+	if r.Empty() || !r.In(image.Rect(0, 0, width, height)) {
+		return image.Rectangle{}, false
+	}
+
+	return r, true
+}
+
+// cropImage returns the r region of img with its origin at (0, 0); unchanged for an unhandled type.
+func cropImage(img image.Image, r image.Rectangle) image.Image {
+	r = r.Add(img.Bounds().Min)
+	if r == img.Bounds() {
+		return img
+	}
+
+	size := image.Rect(0, 0, r.Dx(), r.Dy())
+
+	switch src := img.(type) {
+	case *image.RGBA:
+		sub := src.SubImage(r).(*image.RGBA)
+		return &image.RGBA{Pix: sub.Pix, Stride: sub.Stride, Rect: size}
+	case *image.RGBA64:
+		sub := src.SubImage(r).(*image.RGBA64)
+		return &image.RGBA64{Pix: sub.Pix, Stride: sub.Stride, Rect: size}
+	case *image.NRGBA:
+		sub := src.SubImage(r).(*image.NRGBA)
+		return &image.NRGBA{Pix: sub.Pix, Stride: sub.Stride, Rect: size}
+	case *image.NRGBA64:
+		sub := src.SubImage(r).(*image.NRGBA64)
+		return &image.NRGBA64{Pix: sub.Pix, Stride: sub.Stride, Rect: size}
+	case *image.Gray:
+		sub := src.SubImage(r).(*image.Gray)
+		return &image.Gray{Pix: sub.Pix, Stride: sub.Stride, Rect: size}
+	case *image.Gray16:
+		sub := src.SubImage(r).(*image.Gray16)
+		return &image.Gray16{Pix: sub.Pix, Stride: sub.Stride, Rect: size}
+	default:
+		return img
+	}
+}
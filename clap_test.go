@@ -0,0 +1,156 @@
+package avif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestCleanAperture(t *testing.T) {
+	for _, r := range []image.Rectangle{
+		image.Rect(0, 0, 65, 33),
+		image.Rect(3, 5, 40, 20),
+		image.Rect(1, 1, 66, 34),
+	} {
+		clap := cleanAperture(r, 66, 34)
+
+		b := make([]byte, 0, 32)
+		for _, v := range clap {
+			b = binary.BigEndian.AppendUint32(b, uint32(v))
+		}
+
+		got, ok := cropRect(b, 66, 34)
+		if !ok || got != r {
+			t.Errorf("%v: got %v, %v", r, got, ok)
+		}
+	}
+
+	outside := make([]byte, 0, 32)
+	for _, v := range cleanAperture(image.Rect(0, 0, 80, 34), 66, 34) {
+		outside = binary.BigEndian.AppendUint32(outside, uint32(v))
+	}
+
+	if _, ok := cropRect(outside, 66, 34); ok {
+		t.Error("expected window outside the image to fail")
+	}
+
+	if err := checkCrop(image.Rect(0, 0, 80, 34), 66, 34); err == nil {
+		t.Error("expected error for crop outside the image")
+	}
+}
+
+func TestCropImage(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	img.SetNRGBA(2, 1, color.NRGBA{R: 0xff, A: 0xff})
+
+	crop := cropImage(img, image.Rect(2, 1, 4, 3))
+	if crop.Bounds() != image.Rect(0, 0, 2, 2) {
+		t.Fatalf("got bounds %v", crop.Bounds())
+	}
+
+	if c := crop.(*image.NRGBA).NRGBAAt(0, 0); c.R != 0xff {
+		t.Errorf("got %v at origin", c)
+	}
+
+	rot := applyOrientation(crop, 6)
+	if c := rot.(*image.NRGBA).NRGBAAt(1, 0); c.R != 0xff {
+		t.Errorf("got %v after rotation", c)
+	}
+}
+
+func TestDecodeMetadataClap(t *testing.T) {
+	clap := make([]byte, 0, 32)
+	for _, v := range cleanAperture(image.Rect(0, 0, 63, 47), 64, 48) {
+		clap = binary.BigEndian.AppendUint32(clap, uint32(v))
+	}
+
+	data := testAVIF(testIspe(64, 48), testBox("clap", clap), testBox("pasp", []byte{0, 0, 0, 4, 0, 0, 0, 3}))
+
+	md, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md.Crop != image.Rect(0, 0, 63, 47) {
+		t.Errorf("got crop %v", md.Crop)
+	}
+
+	if md.PixelAspect != (Fraction{4, 3}) {
+		t.Errorf("got pixel aspect %v", md.PixelAspect)
+	}
+}
+
+func TestEncodeCrop(t *testing.T) {
+	skipLegacy(t)
+
+	o := Options{Crop: image.Rect(0, 0, 65, 33), PixelAspect: Fraction{4, 3}, Orientation: 6}
+
+	var b bytes.Buffer
+	err := encode(&b, []image.Image{testCropSource()}, []uint64{1}, encodeOptions([]Options{o}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCrop(t, b.Bytes())
+}
+
+func TestEncodeCropDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	o := Options{Crop: image.Rect(0, 0, 65, 33), PixelAspect: Fraction{4, 3}, Orientation: 6}
+
+	var b bytes.Buffer
+	err := encodeDynamic(&b, []image.Image{testCropSource()}, []uint64{1}, encodeOptions([]Options{o}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCrop(t, b.Bytes())
+}
+
+// testCropSource returns a 66x34 image, 65x33 padded to even dimensions for 4:2:0.
+func testCropSource() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 66, 34))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+
+	return img
+}
+
+func testCrop(t *testing.T, data []byte) {
+	t.Helper()
+
+	md, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if md.Crop != image.Rect(0, 0, 65, 33) || md.PixelAspect != (Fraction{4, 3}) {
+		t.Errorf("got crop %v, pixel aspect %v", md.Crop, md.PixelAspect)
+	}
+
+	img, err := Decode(bytes.NewReader(data), Options{ApplyCrop: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 65 || b.Dy() != 33 {
+		t.Errorf("cropped: got %dx%d, want 65x33", b.Dx(), b.Dy())
+	}
+
+	img, err = Decode(bytes.NewReader(data), Options{ApplyCrop: true, AutoRotate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 33 || b.Dy() != 65 {
+		t.Errorf("cropped and rotated: got %dx%d, want 33x65", b.Dx(), b.Dy())
+	}
+}
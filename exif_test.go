@@ -3,6 +3,7 @@ package avif
 import (
 	"bytes"
 	_ "embed"
+	"image"
 	"testing"
 )
 
@@ -38,3 +39,62 @@ func TestDecodeExifNone(t *testing.T) {
 		t.Errorf("got %v, want ErrNoExif", err)
 	}
 }
+
+func TestEncodeExif(t *testing.T) {
+	skipLegacy(t)
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tiff := exifPayload(bytes.NewReader(testAvifExif))
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`)
+
+	var b bytes.Buffer
+	err = encode(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Exif: tiff, XMP: xmp}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testExifRoundTrip(t, b.Bytes(), xmp)
+}
+
+func TestEncodeExifDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		t.Skip()
+	}
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tiff := exifPayload(bytes.NewReader(testAvifExif))
+	xmp := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/"></x:xmpmeta>`)
+
+	var b bytes.Buffer
+	err = encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Exif: tiff, XMP: xmp}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testExifRoundTrip(t, b.Bytes(), xmp)
+}
+
+func testExifRoundTrip(t *testing.T, data, xmp []byte) {
+	t.Helper()
+
+	ex, err := DecodeExif(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ex.Make != "TestCam" || ex.Model != "Model123" || ex.ISOSpeed != 800 {
+		t.Errorf("got %q %q ISO %d, want TestCam Model123 ISO 800", ex.Make, ex.Model, ex.ISOSpeed)
+	}
+
+	if !bytes.Contains(data, xmp) {
+		t.Error("XMP packet not stored")
+	}
+}
@@ -0,0 +1,662 @@
+package avif
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// encodeInput describes how the frames of an image are handed to libavif.
+type encodeInput struct {
+	width  int
+	height int
+	depth  int
+	// format is the AVIF pixel format of the encoded image.
+	format int
+	// yuv is set when frames are passed as Y'CbCr planes instead of RGBA pixels.
+	yuv bool
+	// alpha is set when yuv frames carry an alpha plane.
+	alpha bool
+	// ignoreAlpha is set when RGBA frames are converted without their alpha channel.
+	ignoreAlpha bool
+	// hdr is the PQ or HLG transfer LinearRGBA frames are converted with.
+	hdr int
+	// straight is set when RGBA frames are passed with unassociated alpha, for NRGBA and NRGBA64 sources.
+	straight bool
+	// premultiplied is set when the color is stored premultiplied by alpha.
+	premultiplied bool
+	// gridCols and gridRows split a still image into equal cells, 1x1 for a single frame.
+	gridCols int
+	gridRows int
+	// crop is the clean aperture written, Options.Crop or the source size of a grid padded to equal cells.
+	crop image.Rectangle
+}
+
+// newEncodeInput picks the pixel layout and grid for images.
+func newEncodeInput(images []image.Image, o Options) (encodeInput, error) {
+	in, err := pixelLayout(images, o)
+	if err != nil {
+		return in, err
+	}
+
+	in.gridCols, in.gridRows, err = gridLayout(in.width, in.height, in.format, o.GridCols, o.GridRows)
+	if err != nil {
+		return in, err
+	}
+
+	if err := checkCrop(o.Crop, in.width, in.height); err != nil {
+		return in, err
+	}
+
+	in.crop = o.Crop
+
+	if in.gridCols*in.gridRows > 1 {
+		if len(images) > 1 {
+			return in, errors.New("grids are not supported for animations")
+		}
+
+		if len(o.Layers) > 0 {
+			return in, errors.New("layers are not supported for grids")
+		}
+
+		width, height := gridSize(in.width, in.height, in.format, in.gridCols, in.gridRows)
+		if width != in.width || height != in.height {
+			if in.crop.Empty() {
+				in.crop = image.Rect(0, 0, in.width, in.height)
+			}
+
+			in.width, in.height = width, height
+		}
+	}
+
+	return in, nil
+}
+
+// pixelLayout picks the pixel layout for images, passing Y'CbCr planes through untouched when possible.
+func pixelLayout(images []image.Image, o Options) (encodeInput, error) {
+	in := encodeInput{
+		width:  images[0].Bounds().Dx(),
+		height: images[0].Bounds().Dy(),
+	}
+
+	var err error
+	in.depth, err = encodeDepth(images[0], o.Depth)
+	if err != nil {
+		return in, err
+	}
+
+	if o.HDR != 0 {
+		if o.HDR != TransferCharacteristicsPQ && o.HDR != TransferCharacteristicsHLG {
+			return in, fmt.Errorf("unsupported HDR transfer %d", o.HDR)
+		}
+
+		if o.Depth == 0 {
+			in.depth = 10
+		} else if in.depth < 10 {
+			return in, fmt.Errorf("unsupported HDR depth %d", in.depth)
+		}
+
+		in.hdr = o.HDR
+	} else if hasLinear(images) {
+		return in, errors.New("LinearRGBA sources need an HDR transfer")
+	}
+
+	if isGray(images) {
+		in.format = avifPixelFormatYuv400
+		in.yuv = true
+
+		return in, nil
+	}
+
+	dropAlpha := o.DropOpaqueAlpha && isOpaque(images)
+
+	if in.depth == 8 {
+		if format, alpha, ok := yuvFormat(images); ok {
+			in.format = format
+			in.yuv = true
+			in.alpha = alpha && !dropAlpha
+
+			return in, nil
+		}
+	}
+
+	in.ignoreAlpha = dropAlpha
+	in.straight = isStraight(images)
+	in.premultiplied = o.PremultipliedAlpha
+
+	switch o.ChromaSubsampling {
+	case image.YCbCrSubsampleRatio444:
+		in.format = avifPixelFormatYuv444
+	case image.YCbCrSubsampleRatio422:
+		in.format = avifPixelFormatYuv422
+	case image.YCbCrSubsampleRatio420:
+		in.format = avifPixelFormatYuv420
+	default:
+		return in, fmt.Errorf("unsupported chroma %d", o.ChromaSubsampling)
+	}
+
+	return in, nil
+}
+
+// frameSize returns the number of bytes one frame takes.
+func (in encodeInput) frameSize() int {
+	bytes := 1
+	if in.depth > 8 {
+		bytes = 2
+	}
+
+	if !in.yuv {
+		return in.width * in.height * 4 * bytes
+	}
+
+	cw, ch := planeSize(in.format, in.width, in.height)
+
+	size := in.width*in.height + 2*cw*ch
+	if in.alpha {
+		size += in.width * in.height
+	}
+
+	return size * bytes
+}
+
+// pix returns the frame m laid out as the encoder reads it.
+func (in encodeInput) pix(m image.Image) []byte {
+	if img, ok := m.(*LinearRGBA); ok {
+		m = img.toNRGBA64(in.hdr)
+	}
+
+	if b := m.Bounds(); b.Dx() != in.width || b.Dy() != in.height {
+		m = padImage(m, in.width, in.height)
+	}
+
+	if in.format == avifPixelFormatYuv400 {
+		return in.grayPlane(m)
+	}
+
+	if in.yuv {
+		return in.planes(m)
+	}
+
+	return framePix(m, in.depth, in.straight)
+}
+
+// planes packs the Y, Cb, Cr and optional alpha planes of m without row padding.
+func (in encodeInput) planes(m image.Image) []byte {
+	var src *image.YCbCr
+	var a *image.NYCbCrA
+
+	switch img := m.(type) {
+	case *image.YCbCr:
+		src = img
+	case *image.NYCbCrA:
+		src = &img.YCbCr
+		a = img
+	}
+
+	r := src.Rect
+	pix := make([]byte, 0, in.frameSize())
+
+	for y := 0; y < in.height; y++ {
+		off := src.YOffset(r.Min.X, r.Min.Y+y)
+		pix = append(pix, src.Y[off:off+in.width]...)
+	}
+
+	sx, sy := 0, 0
+	switch in.format {
+	case avifPixelFormatYuv422:
+		sx = 1
+	case avifPixelFormatYuv420:
+		sx, sy = 1, 1
+	}
+
+	cw, ch := planeSize(in.format, in.width, in.height)
+
+	for _, plane := range [][]byte{src.Cb, src.Cr} {
+		for y := 0; y < ch; y++ {
+			for x := 0; x < cw; x++ {
+				pix = append(pix, plane[src.COffset(r.Min.X+x<<sx, r.Min.Y+y<<sy)])
+			}
+		}
+	}
+
+	if in.alpha {
+		for y := 0; y < in.height; y++ {
+			off := a.AOffset(r.Min.X, r.Min.Y+y)
+			pix = append(pix, a.A[off:off+in.width]...)
+		}
+	}
+
+	return pix
+}
+
+// grayPlane returns the luma of a Gray or Gray16 image scaled to the encoded depth, 16-bit little-endian above 8 bits.
+func (in encodeInput) grayPlane(m image.Image) []byte {
+	r := m.Bounds()
+	maxv := uint32(1)<<in.depth - 1
+
+	pix := make([]byte, 0, in.frameSize())
+
+	put := func(v uint32) {
+		s := (v*maxv + 0x7fff) / 0xffff
+		if in.depth > 8 {
+			pix = append(pix, byte(s), byte(s>>8))
+		} else {
+			pix = append(pix, byte(s))
+		}
+	}
+
+	switch img := m.(type) {
+	case *image.Gray:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			row := img.Pix[img.PixOffset(r.Min.X, y):]
+			if in.depth == 8 {
+				pix = append(pix, row[:in.width]...)
+				continue
+			}
+
+			for x := 0; x < in.width; x++ {
+				put(uint32(row[x]) * 0x101)
+			}
+		}
+	case *image.Gray16:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			row := img.Pix[img.PixOffset(r.Min.X, y):]
+			for x := 0; x < in.width; x++ {
+				put(uint32(row[x*2])<<8 | uint32(row[x*2+1]))
+			}
+		}
+	}
+
+	return pix
+}
+
+// isGray reports whether images are all Gray or Gray16, which are encoded as 4:0:0 monochrome.
+func isGray(images []image.Image) bool {
+	for _, m := range images {
+		switch m.(type) {
+		case *image.Gray, *image.Gray16:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// isOpaque reports whether images are all fully opaque.
+func isOpaque(images []image.Image) bool {
+	for _, m := range images {
+		if o, ok := m.(interface{ Opaque() bool }); !ok || !o.Opaque() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasLinear reports whether any of images is a LinearRGBA.
+func hasLinear(images []image.Image) bool {
+	for _, m := range images {
+		if _, ok := m.(*LinearRGBA); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isStraight reports whether images all have unassociated alpha, NRGBA, NRGBA64 or LinearRGBA.
+func isStraight(images []image.Image) bool {
+	for _, m := range images {
+		switch m.(type) {
+		case *image.NRGBA, *image.NRGBA64, *LinearRGBA:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// yuvFormat returns the AVIF pixel format matching the planes of images, if they are all
+// Y'CbCr images with the same subsampling that AV1 can store.
+func yuvFormat(images []image.Image) (format int, alpha, ok bool) {
+	for i, m := range images {
+		var ratio image.YCbCrSubsampleRatio
+		var a bool
+
+		switch img := m.(type) {
+		case *image.YCbCr:
+			ratio = img.SubsampleRatio
+		case *image.NYCbCrA:
+			ratio = img.SubsampleRatio
+			a = true
+		default:
+			return 0, false, false
+		}
+
+		var f int
+		switch ratio {
+		case image.YCbCrSubsampleRatio444:
+			f = avifPixelFormatYuv444
+		case image.YCbCrSubsampleRatio422:
+			f = avifPixelFormatYuv422
+		case image.YCbCrSubsampleRatio420:
+			f = avifPixelFormatYuv420
+		default:
+			return 0, false, false
+		}
+
+		if i == 0 {
+			format, alpha = f, a
+		} else if f != format || a != alpha {
+			return 0, false, false
+		}
+	}
+
+	return format, alpha, true
+}
+
+// planeSize returns the dimensions of the chroma planes for the AVIF pixel format.
+func planeSize(format, width, height int) (int, int) {
+	switch format {
+	case avifPixelFormatYuv400:
+		return 0, 0
+	case avifPixelFormatYuv422:
+		return (width + 1) / 2, height
+	case avifPixelFormatYuv420:
+		return (width + 1) / 2, (height + 1) / 2
+	}
+
+	return width, height
+}
+
+// AV1 level 6.3 limits, the largest frame a single image item is coded as.
+const (
+	maxFrameWidth  = 16384
+	maxFrameHeight = 8704
+	maxFrameArea   = 35651584
+)
+
+// minGridCell is the smallest grid cell dimension libavif accepts.
+const minGridCell = 64
+
+// gridLayout returns the columns and rows the image is split into. With cols and rows 0 it picks the grid with the
+// fewest cells within the AV1 frame limits, 1x1 when the image fits in a single frame. An automatic grid may need
+// the image padded to equal cells, see gridSize.
+func gridLayout(width, height, format, cols, rows int) (int, int, error) {
+	if cols > 0 || rows > 0 {
+		cols, rows = max(cols, 1), max(rows, 1)
+		if cols*rows > 1 && !gridCells(width, height, format, cols, rows) {
+			return 0, 0, fmt.Errorf("grid %dx%d does not split %dx%d into equal cells", cols, rows, width, height)
+		}
+
+		return cols, rows, nil
+	}
+
+	if width <= maxFrameWidth && height <= maxFrameHeight && width*height <= maxFrameArea {
+		return 1, 1, nil
+	}
+
+	evenWidth, evenHeight := gridEven(format)
+
+	bestCols, bestRows := 0, 0
+	for c := 1; c <= width/minGridCell; c++ {
+		for r := 1; r <= height/minGridCell; r++ {
+			if bestCols > 0 && c*r >= bestCols*bestRows {
+				break
+			}
+
+			cw, ch := gridCell(width, c, evenWidth), gridCell(height, r, evenHeight)
+			if cw <= maxFrameWidth && ch <= maxFrameHeight && cw*ch <= maxFrameArea {
+				bestCols, bestRows = c, r
+
+				break
+			}
+		}
+	}
+
+	if bestCols == 0 {
+		return 0, 0, fmt.Errorf("no grid splits %dx%d into cells within the AV1 frame limits", width, height)
+	}
+
+	return bestCols, bestRows, nil
+}
+
+// gridSize returns the image size cols x rows cells cover, padded up from width and height when they do not
+// split evenly.
+func gridSize(width, height, format, cols, rows int) (int, int) {
+	if gridCells(width, height, format, cols, rows) {
+		return width, height
+	}
+
+	evenWidth, evenHeight := gridEven(format)
+
+	return cols * gridCell(width, cols, evenWidth), rows * gridCell(height, rows, evenHeight)
+}
+
+// gridEven reports whether cell widths and heights must be even for the chroma subsampling of format.
+func gridEven(format int) (width, height bool) {
+	switch format {
+	case avifPixelFormatYuv420:
+		return true, true
+	case avifPixelFormatYuv422:
+		return true, false
+	}
+
+	return false, false
+}
+
+// gridCell returns the size of one of count cells covering n pixels, rounded up to even for subsampled chroma.
+func gridCell(n, count int, even bool) int {
+	cell := (n + count - 1) / count
+	if even {
+		cell += cell % 2
+	}
+
+	return cell
+}
+
+// gridCells reports whether cols x rows splits the image into equal cells that libavif can encode.
+func gridCells(width, height, format, cols, rows int) bool {
+	if width%cols != 0 || height%rows != 0 {
+		return false
+	}
+
+	cw, ch := width/cols, height/rows
+	if cw < minGridCell || ch < minGridCell {
+		return false
+	}
+
+	evenWidth, evenHeight := gridEven(format)
+
+	return (!evenWidth || cw%2 == 0) && (!evenHeight || ch%2 == 0)
+}
+
+// padImage returns m extended to width x height by repeating its right column and bottom row, keeping its pixel
+// layout.
+func padImage(m image.Image, width, height int) image.Image {
+	r := image.Rect(0, 0, width, height)
+
+	switch img := m.(type) {
+	case *image.YCbCr:
+		dst := image.NewYCbCr(r, img.SubsampleRatio)
+		padYCbCr(dst, img)
+
+		return dst
+	case *image.NYCbCrA:
+		dst := image.NewNYCbCrA(r, img.SubsampleRatio)
+		padYCbCr(&dst.YCbCr, &img.YCbCr)
+
+		b := img.Rect
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				dst.A[dst.AOffset(x, y)] = img.A[img.AOffset(b.Min.X+min(x, b.Dx()-1), b.Min.Y+min(y, b.Dy()-1))]
+			}
+		}
+
+		return dst
+	}
+
+	var dst draw.Image
+	switch m.(type) {
+	case *image.RGBA:
+		dst = image.NewRGBA(r)
+	case *image.NRGBA:
+		dst = image.NewNRGBA(r)
+	case *image.NRGBA64:
+		dst = image.NewNRGBA64(r)
+	case *image.Gray:
+		dst = image.NewGray(r)
+	case *image.Gray16:
+		dst = image.NewGray16(r)
+	default:
+		dst = image.NewRGBA64(r)
+	}
+
+	b := m.Bounds()
+	draw.Draw(dst, b.Sub(b.Min), m, b.Min, draw.Src)
+
+	for y := 0; y < height; y++ {
+		for x := b.Dx(); x < width; x++ {
+			dst.Set(x, y, dst.At(b.Dx()-1, min(y, b.Dy()-1)))
+		}
+	}
+
+	for y := b.Dy(); y < height; y++ {
+		for x := 0; x < b.Dx(); x++ {
+			dst.Set(x, y, dst.At(x, b.Dy()-1))
+		}
+	}
+
+	return dst
+}
+
+// padYCbCr fills dst with the Y'CbCr planes of src, repeating its right column and bottom row past its bounds.
+func padYCbCr(dst, src *image.YCbCr) {
+	b := src.Rect
+
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		sy := b.Min.Y + min(y, b.Dy()-1)
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			sx := b.Min.X + min(x, b.Dx()-1)
+			dst.Y[dst.YOffset(x, y)] = src.Y[src.YOffset(sx, sy)]
+
+			ci, si := dst.COffset(x, y), src.COffset(sx, sy)
+			dst.Cb[ci] = src.Cb[si]
+			dst.Cr[ci] = src.Cr[si]
+		}
+	}
+}
+
+func imageToRGBA64(src image.Image) *image.RGBA64 {
+	if dst, ok := src.(*image.RGBA64); ok && dst.Stride == dst.Rect.Dx()*8 {
+		return dst
+	}
+
+	b := src.Bounds()
+	dst := image.NewRGBA64(b)
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+
+	return dst
+}
+
+// imageToNRGBA returns src as NRGBA, converting NRGBA64 without going through premultiplied color.
+func imageToNRGBA(src image.Image) *image.NRGBA {
+	switch img := src.(type) {
+	case *image.NRGBA:
+		if img.Stride == img.Rect.Dx()*4 {
+			return img
+		}
+	case *image.NRGBA64:
+		dst := image.NewNRGBA(img.Rect)
+		for y := 0; y < img.Rect.Dy(); y++ {
+			row := img.Pix[y*img.Stride:]
+			for x := 0; x < img.Rect.Dx()*4; x++ {
+				dst.Pix[y*dst.Stride+x] = row[x*2]
+			}
+		}
+
+		return dst
+	}
+
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+
+	return dst
+}
+
+// imageToNRGBA64 returns src as NRGBA64, converting NRGBA without going through premultiplied color.
+func imageToNRGBA64(src image.Image) *image.NRGBA64 {
+	switch img := src.(type) {
+	case *image.NRGBA64:
+		if img.Stride == img.Rect.Dx()*8 {
+			return img
+		}
+	case *image.NRGBA:
+		dst := image.NewNRGBA64(img.Rect)
+		for y := 0; y < img.Rect.Dy(); y++ {
+			row := img.Pix[y*img.Stride:]
+			for x := 0; x < img.Rect.Dx()*4; x++ {
+				dst.Pix[y*dst.Stride+x*2], dst.Pix[y*dst.Stride+x*2+1] = row[x], row[x]
+			}
+		}
+
+		return dst
+	}
+
+	b := src.Bounds()
+	dst := image.NewNRGBA64(b)
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+
+	return dst
+}
+
+// encodeDepth returns the bit depth m is encoded with, picking 10 for 16-bit color models when depth is 0.
+func encodeDepth(m image.Image, depth int) (int, error) {
+	switch depth {
+	case 0:
+		switch m.ColorModel() {
+		case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model:
+			return 10, nil
+		}
+
+		return 8, nil
+	case 8, 10, 12:
+		return depth, nil
+	}
+
+	return 0, fmt.Errorf("unsupported depth %d", depth)
+}
+
+// framePix returns the RGBA pixels of m as libavif reads them, 16-bit little-endian samples when depth is above 8.
+// The samples are premultiplied by alpha unless straight is set.
+func framePix(m image.Image, depth int, straight bool) []byte {
+	if depth <= 8 {
+		var pix []byte
+		if straight {
+			pix = imageToNRGBA(m).Pix
+		} else {
+			pix = imageToRGBA(m).Pix
+		}
+
+		return pix[:m.Bounds().Dx()*m.Bounds().Dy()*4]
+	}
+
+	var src []byte
+	if straight {
+		src = imageToNRGBA64(m).Pix
+	} else {
+		src = imageToRGBA64(m).Pix
+	}
+
+	pix := make([]byte, m.Bounds().Dx()*m.Bounds().Dy()*8)
+	for i := 0; i < len(pix); i += 2 {
+		pix[i], pix[i+1] = src[i+1], src[i]
+	}
+
+	return pix
+}
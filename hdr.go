@@ -0,0 +1,119 @@
+package avif
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// LinearRGBA is an in-memory image of linear light float32 samples with straight alpha.
+// A value of 1.0 is the HDR reference white of 203 cd/m² (ITU-R BT.2408).
+type LinearRGBA struct {
+	// Pix holds the image's samples, in R, G, B, A order.
+	Pix []float32
+	// Stride is the Pix stride (in samples) between vertically adjacent pixels.
+	Stride int
+	// Rect is the image's bounds.
+	Rect image.Rectangle
+}
+
+// NewLinearRGBA returns a new LinearRGBA image with the given bounds.
+func NewLinearRGBA(r image.Rectangle) *LinearRGBA {
+	return &LinearRGBA{
+		Pix:    make([]float32, 4*r.Dx()*r.Dy()),
+		Stride: 4 * r.Dx(),
+		Rect:   r,
+	}
+}
+
+// ColorModel returns the NRGBA64 color model.
+func (p *LinearRGBA) ColorModel() color.Model {
+	return color.NRGBA64Model
+}
+
+// Bounds returns the image bounds.
+func (p *LinearRGBA) Bounds() image.Rectangle {
+	return p.Rect
+}
+
+// At returns the pixel at (x, y) with the samples clipped to the reference white.
+func (p *LinearRGBA) At(x, y int) color.Color {
+	if !(image.Point{X: x, Y: y}.In(p.Rect)) {
+		return color.NRGBA64{}
+	}
+
+	i := p.PixOffset(x, y)
+
+	return color.NRGBA64{
+		R: hdrSample(0, p.Pix[i]),
+		G: hdrSample(0, p.Pix[i+1]),
+		B: hdrSample(0, p.Pix[i+2]),
+		A: hdrSample(0, p.Pix[i+3]),
+	}
+}
+
+// PixOffset returns the index of the first element of Pix that corresponds to the pixel at (x, y).
+func (p *LinearRGBA) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x-p.Rect.Min.X)*4
+}
+
+// toNRGBA64 returns the image with the color samples encoded with the PQ or HLG transfer.
+func (p *LinearRGBA) toNRGBA64(transfer int) *image.NRGBA64 {
+	dst := image.NewNRGBA64(p.Rect)
+
+	for y := p.Rect.Min.Y; y < p.Rect.Max.Y; y++ {
+		for x := p.Rect.Min.X; x < p.Rect.Max.X; x++ {
+			i := p.PixOffset(x, y)
+			dst.SetNRGBA64(x, y, color.NRGBA64{
+				R: hdrSample(transfer, p.Pix[i]),
+				G: hdrSample(transfer, p.Pix[i+1]),
+				B: hdrSample(transfer, p.Pix[i+2]),
+				A: hdrSample(0, p.Pix[i+3]),
+			})
+		}
+	}
+
+	return dst
+}
+
+// hdrReferenceWhite is the luminance of a linear 1.0, in cd/m².
+const hdrReferenceWhite = 203
+
+// PQ (SMPTE ST 2084) and HLG (ARIB STD-B67) constants.
+const (
+	pqM1 = 2610.0 / 16384
+	pqM2 = 2523.0 / 4096 * 128
+	pqC1 = 3424.0 / 4096
+	pqC2 = 2413.0 / 4096 * 32
+	pqC3 = 2392.0 / 4096 * 32
+
+	hlgA = 0.17883277
+	hlgB = 1 - 4*hlgA
+	hlgC = 0.55991073
+)
+
+// hlgReferenceWhite is the scene light that HLG maps to the 75% reference white signal.
+var hlgReferenceWhite = (math.Exp((0.75-hlgC)/hlgA) + hlgB) / 12
+
+// hdrSample returns the 16-bit code value of a linear sample, clipped to [0,1] when transfer is neither PQ nor HLG.
+func hdrSample(transfer int, v float32) uint16 {
+	e := float64(v)
+	if e <= 0 || math.IsNaN(e) {
+		return 0
+	}
+
+	switch transfer {
+	case TransferCharacteristicsPQ:
+		y := math.Pow(math.Min(e*hdrReferenceWhite/10000, 1), pqM1)
+		e = math.Pow((pqC1+pqC2*y)/(1+pqC3*y), pqM2)
+	case TransferCharacteristicsHLG:
+		e = math.Min(e*hlgReferenceWhite, 1)
+		if e <= 1.0/12 {
+			e = math.Sqrt(3 * e)
+		} else {
+			e = hlgA*math.Log(12*e-hlgB) + hlgC
+		}
+	}
+
+	return uint16(math.Min(e, 1)*0xffff + 0.5)
+}
@@ -0,0 +1,131 @@
+package avif
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestHDRSample(t *testing.T) {
+	cases := []struct {
+		transfer int
+		v        float32
+		want     float64
+	}{
+		{TransferCharacteristicsPQ, 0, 0},
+		{TransferCharacteristicsPQ, 1, 0.58},
+		{TransferCharacteristicsPQ, 10000.0 / hdrReferenceWhite, 1},
+		{TransferCharacteristicsHLG, 1, 0.75},
+		{TransferCharacteristicsHLG, 100, 1},
+		{0, 0.5, 0.5},
+		{0, 2, 1},
+	}
+
+	for _, c := range cases {
+		got := float64(hdrSample(c.transfer, c.v)) / 0xffff
+		if math.Abs(got-c.want) > 0.005 {
+			t.Errorf("transfer %d, %v: got %.4f, want %.4f", c.transfer, c.v, got, c.want)
+		}
+	}
+}
+
+func TestEncodeInputHDR(t *testing.T) {
+	img := NewLinearRGBA(image.Rect(0, 0, 16, 16))
+
+	in, err := newEncodeInput([]image.Image{img}, encodeOptions([]Options{{HDR: TransferCharacteristicsHLG}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if in.depth != 10 || in.hdr != TransferCharacteristicsHLG {
+		t.Errorf("got depth %d, hdr %d, want 10, %d", in.depth, in.hdr, TransferCharacteristicsHLG)
+	}
+
+	_, err = newEncodeInput([]image.Image{img}, encodeOptions([]Options{{HDR: TransferCharacteristicsHLG, Depth: 8}}))
+	if err == nil {
+		t.Error("expected error for 8-bit HDR")
+	}
+
+	_, err = newEncodeInput([]image.Image{img}, encodeOptions([]Options{{HDR: TransferCharacteristicsSRGB}}))
+	if err == nil {
+		t.Error("expected error for SDR transfer")
+	}
+
+	_, err = newEncodeInput([]image.Image{img}, encodeOptions(nil))
+	if err == nil {
+		t.Error("expected error for LinearRGBA without HDR")
+	}
+}
+
+func TestEncodeHDR(t *testing.T) {
+	skipLegacy(t)
+
+	var b bytes.Buffer
+	err := encode(&b, []image.Image{testLinearImage()}, []uint64{1}, encodeOptions([]Options{testHDROptions}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testHDR(t, b.Bytes())
+}
+
+func TestEncodeHDRDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		fmt.Println(err)
+		t.Skip()
+	}
+
+	var b bytes.Buffer
+	err := encodeDynamic(&b, []image.Image{testLinearImage()}, []uint64{1}, encodeOptions([]Options{testHDROptions}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testHDR(t, b.Bytes())
+}
+
+var testHDROptions = Options{HDR: TransferCharacteristicsPQ, MaxCLL: 1000, MaxPALL: 400}
+
+// testLinearImage returns a horizontal ramp from black to 1000 cd/m².
+func testLinearImage() *LinearRGBA {
+	img := NewLinearRGBA(image.Rect(0, 0, 64, 32))
+
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			v := float32(x) / 63 * 1000 / hdrReferenceWhite
+			i := img.PixOffset(x, y)
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = v, v, v, 1
+		}
+	}
+
+	return img
+}
+
+func testHDR(t *testing.T, data []byte) {
+	t.Helper()
+
+	meta, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Color == nil || meta.Color.ColorPrimaries != ColorPrimariesBT2020 || meta.Color.TransferCharacteristics != TransferCharacteristicsPQ {
+		t.Errorf("color: got %+v, want BT.2020 PQ", meta.Color)
+	}
+
+	if meta.MaxCLL != 1000 || meta.MaxPALL != 400 {
+		t.Errorf("clli: got %d/%d, want 1000/400", meta.MaxCLL, meta.MaxPALL)
+	}
+
+	cfg, err := DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ColorModel != color.RGBA64Model {
+		t.Error("expected RGBA64Model for 10-bit HDR")
+	}
+}
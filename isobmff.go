@@ -1,13 +1,42 @@
 package avif
 
-import "encoding/binary"
-
-// avifProps holds the primary item's stored size, bit depth and EXIF orientation.
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+)
+
+// avifProps holds the primary item's stored size, bit depth, chroma layout, color description and EXIF orientation.
 type avifProps struct {
 	width       int
 	height      int
 	hiDepth     bool
+	monochrome  bool
+	alpha       bool
 	orientation int
+	color       *CICP
+	icc         []byte
+	maxCLL      int
+	maxPALL     int
+	crop        image.Rectangle
+	pixelAspect Fraction
+	// grid is set when the primary item is derived from cells, whose clean aperture is always applied.
+	grid bool
+}
+
+// colorModel returns the color model the primary item decodes to.
+func (p avifProps) colorModel() color.Model {
+	switch {
+	case p.monochrome && !p.alpha && p.hiDepth:
+		return color.Gray16Model
+	case p.monochrome && !p.alpha:
+		return color.GrayModel
+	case p.hiDepth:
+		return color.RGBA64Model
+	}
+
+	return color.RGBAModel
 }
 
 type ipcoProp struct {
@@ -21,6 +50,10 @@ func parseAVIFProps(data []byte) (avifProps, bool) {
 
 	meta, ok := metaPayload(data)
 	if !ok {
+		if mini, ok := miniPayload(data); ok {
+			return parseMini(mini)
+		}
+
 		return p, false
 	}
 
@@ -31,15 +64,24 @@ func parseAVIFProps(data []byte) (avifProps, bool) {
 
 	props := ipcoProps(ipco)
 
-	indices := ipmaIndices(ipma, primaryItem(meta))
+	for _, pr := range props {
+		if pr.typ == "auxC" && isAlphaAuxType(pr.data) {
+			p.alpha = true
+		}
+	}
+
+	item := primaryItem(meta)
+
+	indices := ipmaIndices(ipma, item)
 	if len(indices) == 0 {
 		for i := range props {
 			indices = append(indices, i+1)
 		}
 	}
 
-	var haveDim, haveRot, haveMir bool
+	var haveDim, haveAv1C, haveRot, haveMir bool
 	var angle, axis int
+	var clap []byte
 
 	for _, idx := range indices {
 		if idx < 1 || idx > len(props) {
@@ -63,6 +105,24 @@ func parseAVIFProps(data []byte) (avifProps, bool) {
 					}
 				}
 			}
+		case "av1C":
+			if len(pr.data) >= 3 {
+				p.monochrome = pr.data[2]&0x10 != 0
+				haveAv1C = true
+			}
+		case "colr":
+			p.parseColr(pr.data)
+		case "clli":
+			if len(pr.data) >= 4 {
+				p.maxCLL = int(binary.BigEndian.Uint16(pr.data[0:2]))
+				p.maxPALL = int(binary.BigEndian.Uint16(pr.data[2:4]))
+			}
+		case "clap":
+			clap = pr.data
+		case "pasp":
+			if len(pr.data) >= 8 {
+				p.pixelAspect = Fraction{int(binary.BigEndian.Uint32(pr.data[0:4])), int(binary.BigEndian.Uint32(pr.data[4:8]))}
+			}
 		case "irot":
 			if len(pr.data) >= 1 {
 				angle = int(pr.data[0] & 0x3)
@@ -76,11 +136,46 @@ func parseAVIFProps(data []byte) (avifProps, bool) {
 		}
 	}
 
+	cell := dimgItem(meta, item)
+	p.grid = cell >= 0
+
+	// A grid item has no av1C of its own, its cells carry it.
+	if !haveAv1C {
+		for _, idx := range ipmaIndices(ipma, cell) {
+			if idx >= 1 && idx <= len(props) && props[idx-1].typ == "av1C" && len(props[idx-1].data) >= 3 {
+				p.monochrome = props[idx-1].data[2]&0x10 != 0
+			}
+		}
+	}
+
 	p.orientation = exifOrientationFromIrotImir(haveRot, angle, haveMir, axis)
 
+	if clap != nil {
+		p.crop, _ = cropRect(clap, p.width, p.height)
+	}
+
 	return p, haveDim
 }
 
+// isAlphaAuxType reports whether the auxC payload names an alpha plane.
+func isAlphaAuxType(auxC []byte) bool {
+	if len(auxC) < 4 {
+		return false
+	}
+
+	urn := auxC[4:]
+	if i := bytes.IndexByte(urn, 0); i != -1 {
+		urn = urn[:i]
+	}
+
+	switch string(urn) {
+	case "urn:mpeg:mpegB:cicp:systems:auxiliary:alpha", "urn:mpeg:hevc:2015:auxid:1":
+		return true
+	}
+
+	return false
+}
+
 // eachBox iterates the child boxes within b, invoking fn(type, payload) until fn returns false.
 func eachBox(b []byte, fn func(typ string, payload []byte) bool) {
 	off := 0
@@ -130,6 +225,119 @@ func metaPayload(data []byte) ([]byte, bool) {
 	return out, ok
 }
 
+// miniPayload returns the payload of a top-level mini box (reduced header).
+func miniPayload(data []byte) ([]byte, bool) {
+	var out []byte
+	var ok bool
+
+	eachBox(data, func(typ string, payload []byte) bool {
+		if typ == "mini" {
+			out = payload
+			ok = true
+			return false
+		}
+		return true
+	})
+
+	return out, ok
+}
+
+// bitReader reads big-endian bit fields.
+type bitReader struct {
+	b   []byte
+	off int
+	err bool
+}
+
+func (r *bitReader) read(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		if r.off >= len(r.b)*8 {
+			r.err = true
+			return 0
+		}
+
+		v = v<<1 | int(r.b[r.off/8]>>(7-r.off%8)&1)
+		r.off++
+	}
+
+	return v
+}
+
+// parseMini returns the image properties from the header fields of a mini box (ISO/IEC 23008-12 MinimizedImageBox).
+// The ICC profile and HDR metadata stored after them are not read.
+func parseMini(mini []byte) (avifProps, bool) {
+	p := avifProps{orientation: 1}
+	r := &bitReader{b: mini}
+
+	if r.read(2) != 0 {
+		return p, false
+	}
+
+	r.read(1) // explicit_codec_types_flag
+	floatFlag := r.read(1)
+	fullRange := r.read(1) != 0
+	p.alpha = r.read(1) != 0
+	explicitCICP := r.read(1) != 0
+	r.read(1) // hdr_flag
+	icc := r.read(1) != 0
+	r.read(2) // exif_flag, xmp_flag
+
+	chroma := r.read(2)
+	p.monochrome = chroma == 0
+	p.orientation = r.read(3) + 1
+
+	bits := 7
+	if r.read(1) != 0 {
+		bits = 15
+	}
+	p.width = r.read(bits) + 1
+	p.height = r.read(bits) + 1
+
+	if chroma == 1 || chroma == 2 {
+		r.read(1) // chroma_is_horizontally_centered
+	}
+	if chroma == 1 {
+		r.read(1) // chroma_is_vertically_centered
+	}
+
+	if floatFlag != 0 {
+		return p, false
+	}
+
+	if r.read(1) != 0 {
+		r.read(3) // bit_depth_minus9
+		p.hiDepth = true
+	}
+
+	if p.alpha {
+		r.read(1) // alpha_is_premultiplied
+	}
+
+	c := CICP{
+		ColorPrimaries:          ColorPrimariesBT709,
+		TransferCharacteristics: TransferCharacteristicsSRGB,
+		MatrixCoefficients:      MatrixCoefficientsBT601,
+		FullRange:               fullRange,
+	}
+	if icc {
+		c.ColorPrimaries, c.TransferCharacteristics = ColorPrimariesUnspecified, TransferCharacteristicsUnspecified
+	}
+	if explicitCICP {
+		c.ColorPrimaries = r.read(8)
+		c.TransferCharacteristics = r.read(8)
+		if chroma != 0 {
+			c.MatrixCoefficients = r.read(8)
+		}
+	}
+	if chroma == 0 {
+		c.MatrixCoefficients = MatrixCoefficientsUnspecified
+	}
+	p.color = &c
+
+	return p, !r.err
+}
+
 // primaryItem returns the primary item ID from the pitm box, or -1 when absent.
 func primaryItem(meta []byte) int {
 	id := -1
@@ -151,6 +359,50 @@ func primaryItem(meta []byte) int {
 	return id
 }
 
+// dimgItem returns the first item a grid item derives from in its dimg reference, or -1 when absent.
+func dimgItem(meta []byte, item int) int {
+	id := -1
+
+	eachBox(meta, func(typ string, payload []byte) bool {
+		if typ != "iref" {
+			return true
+		}
+
+		if len(payload) < 4 {
+			return false
+		}
+
+		size := 2
+		if payload[0] != 0 {
+			size = 4
+		}
+
+		readID := func(b []byte) int {
+			if size == 2 {
+				return int(binary.BigEndian.Uint16(b))
+			}
+
+			return int(binary.BigEndian.Uint32(b))
+		}
+
+		eachBox(payload[4:], func(t string, p []byte) bool {
+			if t != "dimg" || len(p) < 2*size+2 || readID(p) != item {
+				return true
+			}
+
+			if binary.BigEndian.Uint16(p[size:size+2]) > 0 {
+				id = readID(p[size+2:])
+			}
+
+			return false
+		})
+
+		return false
+	})
+
+	return id
+}
+
 // iprpBoxes returns the ipco and ipma payloads from the iprp box.
 func iprpBoxes(meta []byte) (ipco, ipma []byte) {
 	eachBox(meta, func(typ string, payload []byte) bool {
@@ -0,0 +1,253 @@
+package avif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParsePropsMonochrome(t *testing.T) {
+	data := testAVIF(testIspe(64, 48), testBox("av1C", []byte{0x81, 0x00, 0x1c, 0x00}))
+
+	p, ok := parseAVIFProps(data)
+	if !ok {
+		t.Fatal("no dimensions parsed")
+	}
+
+	if !p.monochrome {
+		t.Error("expected monochrome")
+	}
+
+	if p.colorModel() != color.GrayModel {
+		t.Error("expected GrayModel")
+	}
+
+	auxC := testBox("auxC", []byte{0, 0, 0, 0}, []byte("urn:mpeg:mpegB:cicp:systems:auxiliary:alpha\x00"))
+	data = testAVIF(testIspe(64, 48), testBox("av1C", []byte{0x81, 0x00, 0x1c, 0x00}), auxC)
+
+	p, _ = parseAVIFProps(data)
+	if !p.alpha {
+		t.Error("expected alpha")
+	}
+
+	if p.colorModel() != color.RGBAModel {
+		t.Error("expected RGBAModel for monochrome with alpha")
+	}
+}
+
+func TestParsePropsMonochromeGrid(t *testing.T) {
+	ftyp := testBox("ftyp", []byte("avif\x00\x00\x00\x00avifmif1"))
+	pitm := testBox("pitm", []byte{0, 0, 0, 0, 0, 1})
+	var clap []byte
+	for _, v := range cleanAperture(image.Rect(0, 0, 126, 64), 128, 64) {
+		clap = binary.BigEndian.AppendUint32(clap, uint32(v))
+	}
+
+	ipco := testBox("ipco", testIspe(128, 64), testBox("av1C", []byte{0x81, 0x00, 0x1c, 0x00}), testBox("clap", clap))
+	ipma := testBox("ipma", []byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 1, 2, 1, 3, 0, 2, 1, 2})
+	iref := testBox("iref", []byte{0, 0, 0, 0}, testBox("dimg", []byte{0, 1, 0, 2, 0, 2, 0, 3}))
+
+	data := append(ftyp, testBox("meta", []byte{0, 0, 0, 0}, pitm, iref, testBox("iprp", ipco, ipma))...)
+
+	p, ok := parseAVIFProps(data)
+	if !ok {
+		t.Fatal("no dimensions parsed")
+	}
+
+	if p.width != 128 || p.height != 64 || !p.monochrome || !p.grid {
+		t.Errorf("got %dx%d monochrome %v grid %v, want a 128x64 monochrome grid", p.width, p.height, p.monochrome, p.grid)
+	}
+
+	cfg, err := DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Width != 126 || cfg.Height != 64 || cfg.ColorModel != color.GrayModel {
+		t.Errorf("config: got %dx%d, want the 126x64 clean aperture in GrayModel", cfg.Width, cfg.Height)
+	}
+}
+
+func TestDecodeMetadata(t *testing.T) {
+	nclx := testBox("colr", []byte("nclx"), []byte{0, 9, 0, 16, 0, 9, 0x80})
+	prof := testBox("colr", []byte("prof"), []byte("icc"))
+	irot := testBox("irot", []byte{3})
+	clli := testBox("clli", []byte{0x03, 0xe8, 0x01, 0x90})
+
+	meta, err := DecodeMetadata(bytes.NewReader(testAVIF(testIspe(64, 48), nclx, prof, irot, clli)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := CICP{ColorPrimariesBT2020, 16, MatrixCoefficientsBT2020NCL, true}
+	if meta.Color == nil || *meta.Color != want {
+		t.Errorf("color: got %+v, want %+v", meta.Color, want)
+	}
+
+	if string(meta.ICC) != "icc" {
+		t.Errorf("icc: got %q, want %q", meta.ICC, "icc")
+	}
+
+	if meta.Orientation != 6 {
+		t.Errorf("orientation: got %d, want 6", meta.Orientation)
+	}
+
+	if meta.MaxCLL != 1000 || meta.MaxPALL != 400 {
+		t.Errorf("clli: got %d/%d, want 1000/400", meta.MaxCLL, meta.MaxPALL)
+	}
+
+	meta, err = DecodeMetadata(bytes.NewReader(testAVIF(testIspe(64, 48))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if meta.Color != nil || meta.ICC != nil {
+		t.Error("expected no color description")
+	}
+}
+
+func TestColorDescription(t *testing.T) {
+	want := CICP{ColorPrimariesUnspecified, TransferCharacteristicsUnspecified, MatrixCoefficientsBT601, true}
+	if c := colorDescription(encodeInput{}, Options{}); c != want {
+		t.Errorf("default: got %+v, want the libavif defaults %+v", c, want)
+	}
+
+	o := Options{Color: &CICP{ColorPrimariesBT709, TransferCharacteristicsSRGB, MatrixCoefficientsBT709, false}}
+
+	c := colorDescription(encodeInput{}, o)
+	if c != *o.Color {
+		t.Errorf("rgb: got %+v, want %+v", c, *o.Color)
+	}
+
+	c = colorDescription(encodeInput{yuv: true}, o)
+	if c.MatrixCoefficients != MatrixCoefficientsBT601 || !c.FullRange || c.ColorPrimaries != ColorPrimariesBT709 {
+		t.Errorf("yuv: got %+v", c)
+	}
+
+	o.Lossless = true
+	c = colorDescription(encodeInput{}, o)
+	if c.MatrixCoefficients != MatrixCoefficientsIdentity || !c.FullRange {
+		t.Errorf("lossless: got %+v", c)
+	}
+}
+
+func TestImageToGray(t *testing.T) {
+	src := image.NewRGBA64(image.Rect(0, 0, 3, 2))
+	src.SetRGBA64(2, 1, color.RGBA64{R: 0x1234, G: 0x1234, B: 0x1234, A: 0xffff})
+
+	dst, ok := imageToGray(src).(*image.Gray16)
+	if !ok {
+		t.Fatal("expected *image.Gray16")
+	}
+
+	if got := dst.Gray16At(2, 1).Y; got != 0x1234 {
+		t.Errorf("got %#x, want %#x", got, 0x1234)
+	}
+}
+
+func TestParseMini(t *testing.T) {
+	var w testBitWriter
+	w.write(0, 2)                           // version
+	w.write(0b001110000, 9)                 // full range, alpha and explicit CICP flags
+	w.write(1, 2)                           // 4:2:0
+	w.write(5, 3)                           // orientation 6
+	w.write(1, 1)                           // large dimensions
+	w.write(299, 15)                        // width 300
+	w.write(199, 15)                        // height 200
+	w.write(0, 2)                           // chroma positions
+	w.write(1, 1)                           // high bit depth
+	w.write(1, 3)                           // 10-bit
+	w.write(0, 1)                           // alpha not premultiplied
+	w.write(ColorPrimariesBT2020, 8)        // primaries
+	w.write(TransferCharacteristicsPQ, 8)   // transfer
+	w.write(MatrixCoefficientsBT2020NCL, 8) // matrix
+
+	data := append(testBox("ftyp", []byte("mif3avif")), testBox("mini", w.bytes())...)
+
+	p, ok := parseAVIFProps(data)
+	if !ok {
+		t.Fatal("no dimensions parsed")
+	}
+
+	if p.width != 300 || p.height != 200 || !p.hiDepth || !p.alpha || p.monochrome || p.orientation != 6 {
+		t.Errorf("got %+v", p)
+	}
+
+	want := CICP{ColorPrimariesBT2020, TransferCharacteristicsPQ, MatrixCoefficientsBT2020NCL, true}
+	if p.color == nil || *p.color != want {
+		t.Errorf("got color %v, want %v", p.color, want)
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if format != "avif" || cfg.Width != 300 || cfg.Height != 200 || cfg.ColorModel != color.RGBA64Model {
+		t.Errorf("got %s %dx%d", format, cfg.Width, cfg.Height)
+	}
+
+	if _, ok := parseAVIFProps(append(testBox("ftyp", []byte("mif3avif")), testBox("mini", []byte{0x00})...)); ok {
+		t.Error("expected truncated mini box to fail")
+	}
+}
+
+// testBitWriter packs big-endian bit fields.
+type testBitWriter struct {
+	b []byte
+	n int
+}
+
+func (w *testBitWriter) write(v, bits int) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+
+		w.b[len(w.b)-1] |= byte(v>>i&1) << (7 - w.n%8)
+		w.n++
+	}
+}
+
+func (w *testBitWriter) bytes() []byte {
+	return w.b
+}
+
+// testBox builds an ISOBMFF box of type typ around the concatenated payloads.
+func testBox(typ string, payload ...[]byte) []byte {
+	b := make([]byte, 8)
+	copy(b[4:], typ)
+
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+
+	return b
+}
+
+// testIspe builds an ispe property for the given dimensions.
+func testIspe(width, height int) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b[4:], uint32(width))
+	binary.BigEndian.PutUint32(b[8:], uint32(height))
+
+	return testBox("ispe", b)
+}
+
+// testAVIF builds a minimal AVIF header whose primary item 1 is associated with all props.
+func testAVIF(props ...[]byte) []byte {
+	ipma := []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 1, byte(len(props))}
+	for i := range props {
+		ipma = append(ipma, byte(i+1))
+	}
+
+	ftyp := testBox("ftyp", []byte("avif\x00\x00\x00\x00avifmif1"))
+	pitm := testBox("pitm", []byte{0, 0, 0, 0, 0, 1})
+	iprp := testBox("iprp", testBox("ipco", props...), testBox("ipma", ipma))
+
+	return append(ftyp, testBox("meta", []byte{0, 0, 0, 0}, pitm, iprp)...)
+}
@@ -1,13 +1,48 @@
 #include <stdlib.h>
 #include <string.h>
+#include <time.h>
 
 #include "avif/avif.h"
 
-int decode(uint8_t *avif_in, int avif_in_size, int config_only, int decode_all, uint32_t *width, uint32_t *height, uint32_t *depth, uint32_t *count, uint8_t *delay, uint8_t *out);
-uint8_t* encode(uint8_t *rgb_in, int width, int height, size_t *size, int quality, int quality_alpha, int speed, int chroma, int lossless);
+int decode(uint8_t *avif_in, int avif_in_size, int config_only, int decode_all, int straight, int ignore_grain, uint32_t *width, uint32_t *height, uint32_t *depth, uint32_t *gray, uint32_t *count, uint8_t *delay, uint8_t *out, uint64_t *stats);
+uint8_t* encode(uint8_t *in, int yuv, int alpha, int width, int height, int depth, int count, uint64_t *durations, size_t *size,
+    int quality, int quality_alpha, int speed, int chroma, uint64_t timescale, int keyframe_interval, int repetition_count,
+    uint8_t *icc, int icc_size, uint8_t *exif, int exif_size, uint8_t *xmp, int xmp_size,
+    int transform_flags, int irot_angle, int imir_axis,
+    int color_primaries, int transfer_characteristics, int matrix_coefficients, int full_range,
+    int max_cll, int max_pall,
+    int tile_rows_log2, int tile_cols_log2, int auto_tiling,
+    int min_quantizer, int max_quantizer, int min_quantizer_alpha, int max_quantizer_alpha,
+    char *codec_options, int codec_options_count, int32_t *layers, int layer_count,
+    int grid_cols, int grid_rows, int straight, int premultiplied, int ignore_alpha, int header_format,
+    int32_t *clap, int pasp_h, int pasp_v, int chroma_downsampling,
+    int scale_n, int scale_d, size_t target_size, int *chosen_quality, uint64_t *stats, char *diag);
+
+// Read by the patched codec_dav1d.c when the dav1d decoder is created, libavif has no setting for it.
+int avif_apply_grain = 1;
+
+// now_ns returns the monotonic clock in nanoseconds.
+static uint64_t now_ns(void) {
+    struct timespec ts;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+
+    return (uint64_t)ts.tv_sec * 1000000000 + ts.tv_nsec;
+}
+
+// set_stats writes the color and alpha OBU sizes and the conversion and coding times in nanoseconds to stats.
+static void set_stats(uint64_t *stats, avifIOStats io_stats, uint64_t convert_ns, uint64_t codec_ns) {
+    if(stats == NULL) {
+        return;
+    }
+
+    stats[0] = io_stats.colorOBUSize;
+    stats[1] = io_stats.alphaOBUSize;
+    stats[2] = convert_ns;
+    stats[3] = codec_ns;
+}
 
-int decode(uint8_t *avif_in, int avif_in_size, int config_only, int decode_all, uint32_t *width, uint32_t *height,
-    uint32_t *depth, uint32_t *count, uint8_t *delay, uint8_t *out) {
+int decode(uint8_t *avif_in, int avif_in_size, int config_only, int decode_all, int straight, int ignore_grain, uint32_t *width, uint32_t *height,
+    uint32_t *depth, uint32_t *gray, uint32_t *count, uint8_t *delay, uint8_t *out, uint64_t *stats) {
 
     avifDecoder *decoder = avifDecoderCreate();
     decoder->ignoreExif = 1;
@@ -15,21 +50,29 @@ int decode(uint8_t *avif_in, int avif_in_size, int config_only, int decode_all,
     decoder->maxThreads = 1;
     decoder->strictFlags = 0;
 
+    avif_apply_grain = !ignore_grain;
+
     avifResult result = avifDecoderSetIOMemory(decoder, avif_in, avif_in_size);
     if(result != AVIF_RESULT_OK) {
         avifDecoderDestroy(decoder);
         return 0;
     }
 
+    uint64_t start = now_ns();
+    uint64_t convert_ns = 0, codec_ns = 0;
+
     result = avifDecoderParse(decoder);
     if(result != AVIF_RESULT_OK) {
         avifDecoderDestroy(decoder);
         return 0;
     }
 
+    codec_ns += now_ns() - start;
+
     *width = (uint32_t)decoder->image->width;
     *height = (uint32_t)decoder->image->height;
     *depth = (uint32_t)decoder->image->depth;
+    *gray = decoder->image->yuvFormat == AVIF_PIXEL_FORMAT_YUV400 && !decoder->alphaPresent;
     *count = (uint32_t)decoder->imageCount;
 
     if(config_only) {
@@ -41,7 +84,7 @@ int decode(uint8_t *avif_in, int avif_in_size, int config_only, int decode_all,
     avifRGBImageSetDefaults(&rgb, decoder->image);
 
     rgb.maxThreads = 1;
-    rgb.alphaPremultiplied = 1;
+    rgb.alphaPremultiplied = !straight;
 
     if(decoder->image->depth > 8) {
         rgb.depth = 16;
@@ -51,19 +94,27 @@ int decode(uint8_t *avif_in, int avif_in_size, int config_only, int decode_all,
         rgb.chromaUpsampling = AVIF_CHROMA_UPSAMPLING_FASTEST;
     }
 
-    while(avifDecoderNextImage(decoder) == AVIF_RESULT_OK) {
+    for(;;) {
+        start = now_ns();
+        if(avifDecoderNextImage(decoder) != AVIF_RESULT_OK) {
+            break;
+        }
+        codec_ns += now_ns() - start;
+
         result = avifRGBImageAllocatePixels(&rgb);
         if(result != AVIF_RESULT_OK) {
             avifDecoderDestroy(decoder);
             return 0;
         }
 
+        start = now_ns();
         result = avifImageYUVToRGB(decoder->image, &rgb);
         if(result != AVIF_RESULT_OK) {
             avifRGBImageFreePixels(&rgb);
             avifDecoderDestroy(decoder);
             return 0;
         }
+        convert_ns += now_ns() - start;
 
         int buf_size = rgb.rowBytes * rgb.height;
         memcpy(out + buf_size*decoder->imageIndex, rgb.pixels, buf_size);
@@ -73,75 +124,365 @@ int decode(uint8_t *avif_in, int avif_in_size, int config_only, int decode_all,
         avifRGBImageFreePixels(&rgb);
 
         if(!decode_all) {
-            avifDecoderDestroy(decoder);
-            return 1;
+            break;
         }
     }
 
+    set_stats(stats, decoder->ioStats, convert_ns, codec_ns);
+
     avifDecoderDestroy(decoder);
     return 1;
 }
 
-uint8_t* encode(uint8_t *rgb_in, int width, int height, size_t *size, int quality, int quality_alpha, int speed, int chroma, int lossless) {
+// copy_planes copies the tightly packed Y, U, V and (optionally) alpha planes of one frame into image
+// and returns the number of bytes consumed.
+static size_t copy_planes(avifImage *image, uint8_t *in, int alpha) {
+    size_t off = 0;
+    int bytes = image->depth > 8 ? 2 : 1;
+    int channels = alpha ? 4 : 3;
+
+    for(int c = 0; c < channels; c++) {
+        uint8_t *plane = avifImagePlane(image, c);
+        if(plane == NULL) {
+            continue;
+        }
+
+        uint32_t row_bytes = avifImagePlaneRowBytes(image, c);
+        uint32_t width = avifImagePlaneWidth(image, c) * bytes;
+        uint32_t height = avifImagePlaneHeight(image, c);
+
+        for(uint32_t y = 0; y < height; y++) {
+            memcpy(plane + (size_t)row_bytes*y, in + off, width);
+            off += width;
+        }
+    }
+
+    return off;
+}
+
+// set_codec_options passes count tightly packed, NUL-terminated key/value pairs to the codec.
+static avifResult set_codec_options(avifEncoder *encoder, char *options, int count) {
+    for(int i = 0; i < count; i++) {
+        char *key = options;
+        char *value = key + strlen(key) + 1;
+
+        avifResult result = avifEncoderSetCodecSpecificOption(encoder, key, value);
+        if(result != AVIF_RESULT_OK) {
+            return result;
+        }
+
+        options = value + strlen(value) + 1;
+    }
+
+    return AVIF_RESULT_OK;
+}
+
+// add_layers adds image once per layer, with the quality and scale given as int32 triples in layers.
+static avifResult add_layers(avifEncoder *encoder, avifImage *image, int32_t *layers, int count) {
+    for(int i = 0; i < count; i++) {
+        avifFraction scale = {layers[i*3+1], layers[i*3+2]};
+
+        encoder->quality = layers[i*3];
+        encoder->scalingMode.horizontal = scale;
+        encoder->scalingMode.vertical = scale;
+
+        avifResult result = avifEncoderAddImage(encoder, image, 1, AVIF_ADD_IMAGE_FLAG_NONE);
+        if(result != AVIF_RESULT_OK) {
+            return result;
+        }
+    }
+
+    return AVIF_RESULT_OK;
+}
+
+// add_grid adds image split into cols x rows equal cells. The cells are views into image, the first one
+// also carries the metadata libavif writes for the grid.
+static avifResult add_grid(avifEncoder *encoder, avifImage *image, int cols, int rows) {
+    int count = cols * rows;
+    uint32_t cell_width = image->width / cols;
+    uint32_t cell_height = image->height / rows;
+
+    avifImage **cells = calloc(count, sizeof(avifImage *));
+    if(!cells) {
+        return AVIF_RESULT_OUT_OF_MEMORY;
+    }
+
+    avifResult result = AVIF_RESULT_OK;
+
+    for(int i = 0; i < count && result == AVIF_RESULT_OK; i++) {
+        avifCropRect rect = {(i % cols) * cell_width, (i / cols) * cell_height, cell_width, cell_height};
+
+        cells[i] = avifImageCreateEmpty();
+        if(!cells[i]) {
+            result = AVIF_RESULT_OUT_OF_MEMORY;
+            break;
+        }
+
+        result = avifImageSetViewRect(cells[i], image, &rect);
+    }
+
+    if(result == AVIF_RESULT_OK) {
+        result = avifRWDataSet(&cells[0]->icc, image->icc.data, image->icc.size);
+    }
+    if(result == AVIF_RESULT_OK) {
+        result = avifRWDataSet(&cells[0]->exif, image->exif.data, image->exif.size);
+    }
+    if(result == AVIF_RESULT_OK) {
+        result = avifRWDataSet(&cells[0]->xmp, image->xmp.data, image->xmp.size);
+    }
+
+    if(result == AVIF_RESULT_OK) {
+        result = avifEncoderAddImageGrid(encoder, cols, rows, (const avifImage * const *)cells, AVIF_ADD_IMAGE_FLAG_SINGLE);
+    }
+
+    for(int i = 0; i < count; i++) {
+        if(cells[i]) {
+            avifImageDestroy(cells[i]);
+        }
+    }
+    free(cells);
+
+    return result;
+}
+
+// add_frames adds count frames from in, converting them into image first when convert is set and adding the
+// conversion time to convert_ns.
+static avifResult add_frames(avifEncoder *encoder, avifImage *image, avifRGBImage *rgb, uint8_t *in, int yuv, int alpha,
+    int count, uint64_t *durations, int convert, int32_t *layers, int layer_count, int grid_cols, int grid_rows,
+    uint64_t *convert_ns) {
+
     avifResult result;
 
-    avifImage *image = avifImageCreate(width, height, 8, chroma);
+    avifAddImageFlags flags = AVIF_ADD_IMAGE_FLAG_NONE;
+    if(count == 1) {
+        flags = AVIF_ADD_IMAGE_FLAG_SINGLE;
+    }
+
+    uint8_t *frame = in;
+
+    for(int i = 0; i < count; i++) {
+        uint64_t start = now_ns();
 
-    if(lossless) {
-        image->matrixCoefficients = AVIF_MATRIX_COEFFICIENTS_IDENTITY;
-        image->yuvRange = AVIF_RANGE_FULL;
+        if(convert && yuv) {
+            frame += copy_planes(image, frame, alpha);
+        } else if(convert) {
+            rgb->pixels = frame;
+            frame += (size_t)rgb->rowBytes*image->height;
+
+            result = avifImageRGBToYUV(image, rgb);
+            if(result != AVIF_RESULT_OK) {
+                return result;
+            }
+        }
+
+        *convert_ns += now_ns() - start;
+
+        if(grid_cols * grid_rows > 1) {
+            result = add_grid(encoder, image, grid_cols, grid_rows);
+        } else if(layer_count > 0) {
+            result = add_layers(encoder, image, layers, layer_count);
+        } else {
+            result = avifEncoderAddImage(encoder, image, durations[i], flags);
+        }
+
+        if(result != AVIF_RESULT_OK) {
+            return result;
+        }
+    }
+
+    return AVIF_RESULT_OK;
+}
+
+uint8_t* encode(uint8_t *in, int yuv, int alpha, int width, int height, int depth, int count, uint64_t *durations, size_t *size,
+    int quality, int quality_alpha, int speed, int chroma, uint64_t timescale, int keyframe_interval, int repetition_count,
+    uint8_t *icc, int icc_size, uint8_t *exif, int exif_size, uint8_t *xmp, int xmp_size,
+    int transform_flags, int irot_angle, int imir_axis,
+    int color_primaries, int transfer_characteristics, int matrix_coefficients, int full_range,
+    int max_cll, int max_pall,
+    int tile_rows_log2, int tile_cols_log2, int auto_tiling,
+    int min_quantizer, int max_quantizer, int min_quantizer_alpha, int max_quantizer_alpha,
+    char *codec_options, int codec_options_count, int32_t *layers, int layer_count,
+    int grid_cols, int grid_rows, int straight, int premultiplied, int ignore_alpha, int header_format,
+    int32_t *clap, int pasp_h, int pasp_v, int chroma_downsampling,
+    int scale_n, int scale_d, size_t target_size, int *chosen_quality, uint64_t *stats, char *diag) {
+
+    avifResult result;
+    diag[0] = '\0';
+    *size = 0;
+
+    avifImage *image = avifImageCreate(width, height, depth, chroma);
+
+    image->colorPrimaries = color_primaries;
+    image->transferCharacteristics = transfer_characteristics;
+    image->matrixCoefficients = matrix_coefficients;
+    image->yuvRange = full_range ? AVIF_RANGE_FULL : AVIF_RANGE_LIMITED;
+    image->clli.maxCLL = max_cll;
+    image->clli.maxPALL = max_pall;
+    image->alphaPremultiplied = premultiplied;
+
+    if(yuv) {
+        result = avifImageAllocatePlanes(image, alpha ? AVIF_PLANES_ALL : AVIF_PLANES_YUV);
+        if(result != AVIF_RESULT_OK) {
+            avifImageDestroy(image);
+            return 0;
+        }
+    }
+
+    if(icc_size > 0) {
+        result = avifImageSetProfileICC(image, icc, icc_size);
+        if(result != AVIF_RESULT_OK) {
+            avifImageDestroy(image);
+            return 0;
+        }
+    }
+
+    if(exif_size > 0) {
+        result = avifImageSetMetadataExif(image, exif, exif_size);
+        if(result != AVIF_RESULT_OK) {
+            avifImageDestroy(image);
+            return 0;
+        }
+    }
+
+    if(xmp_size > 0) {
+        result = avifImageSetMetadataXMP(image, xmp, xmp_size);
+        if(result != AVIF_RESULT_OK) {
+            avifImageDestroy(image);
+            return 0;
+        }
+    }
+
+    if(transform_flags >= 0) {
+        image->transformFlags = transform_flags;
+        image->irot.angle = irot_angle;
+        image->imir.axis = imir_axis;
+    }
+
+    if(clap != NULL) {
+        image->clap.widthN = clap[0];
+        image->clap.widthD = clap[1];
+        image->clap.heightN = clap[2];
+        image->clap.heightD = clap[3];
+        image->clap.horizOffN = clap[4];
+        image->clap.horizOffD = clap[5];
+        image->clap.vertOffN = clap[6];
+        image->clap.vertOffD = clap[7];
+        image->transformFlags |= AVIF_TRANSFORM_CLAP;
+    }
+
+    if(pasp_h > 0 && pasp_v > 0) {
+        image->pasp.hSpacing = pasp_h;
+        image->pasp.vSpacing = pasp_v;
+        image->transformFlags |= AVIF_TRANSFORM_PASP;
     }
 
     avifRGBImage rgb;
     avifRGBImageSetDefaults(&rgb, image);
 
     rgb.maxThreads = 1;
-    rgb.alphaPremultiplied = 1;
+    rgb.alphaPremultiplied = !straight;
+    rgb.ignoreAlpha = ignore_alpha;
+    rgb.chromaDownsampling = chroma_downsampling;
+    rgb.rowBytes = width * 4;
 
-    result = avifRGBImageAllocatePixels(&rgb);
-    if(result != AVIF_RESULT_OK) {
-        avifImageDestroy(image);
-        return 0;
+    if(depth > 8) {
+        rgb.depth = 16;
+        rgb.rowBytes = width * 8;
     }
 
-    rgb.pixels = rgb_in;
+    avifRWData output = AVIF_DATA_EMPTY;
 
-    result = avifImageRGBToYUV(image, &rgb);
-    if(result != AVIF_RESULT_OK) {
-        avifImageDestroy(image);
-        avifRGBImageFreePixels(&rgb);
-        return 0;
-    }
+    // With a target size the still image is encoded repeatedly, binary searching the highest quality
+    // that fits. The frame is converted on the first attempt only and kept in image.
+    int lo = 0, hi = 100;
+    int converted = 0;
+
+    avifIOStats io_stats = {0, 0};
+    uint64_t convert_ns = 0, total_ns = 0;
+
+    *chosen_quality = target_size > 0 ? -1 : quality;
+
+    while(target_size == 0 || lo <= hi) {
+        int attempt_quality = target_size > 0 ? (lo + hi) / 2 : quality;
+
+        avifEncoder *encoder = avifEncoderCreate();
+        encoder->maxThreads = 1;
+        encoder->quality = attempt_quality;
+        encoder->qualityAlpha = quality_alpha;
+        encoder->minQuantizer = min_quantizer;
+        encoder->maxQuantizer = max_quantizer;
+        encoder->minQuantizerAlpha = min_quantizer_alpha;
+        encoder->maxQuantizerAlpha = max_quantizer_alpha;
+        encoder->speed = speed;
+        encoder->timescale = timescale;
+        encoder->keyframeInterval = keyframe_interval;
+        encoder->repetitionCount = repetition_count;
+        encoder->tileRowsLog2 = tile_rows_log2;
+        encoder->tileColsLog2 = tile_cols_log2;
+        encoder->autoTiling = auto_tiling;
+        encoder->headerFormat = header_format;
+        encoder->scalingMode.horizontal = (avifFraction){scale_n, scale_d};
+        encoder->scalingMode.vertical = (avifFraction){scale_n, scale_d};
+
+        if(layer_count > 0) {
+            encoder->extraLayerCount = layer_count - 1;
+        }
 
-    avifRWData output = AVIF_DATA_EMPTY;
+        uint64_t start = now_ns();
 
-    avifEncoder *encoder = avifEncoderCreate();
-    encoder->maxThreads = 1;
-    encoder->quality = quality;
-    encoder->qualityAlpha = quality_alpha;
-    encoder->speed = speed;
+        result = set_codec_options(encoder, codec_options, codec_options_count);
+        if(result == AVIF_RESULT_OK) {
+            result = add_frames(encoder, image, &rgb, in, yuv, alpha, count, durations, !converted,
+                layers, layer_count, grid_cols, grid_rows, &convert_ns);
+        }
 
-    result = avifEncoderAddImage(encoder, image, 1, AVIF_ADD_IMAGE_FLAG_SINGLE);
-    if(result != AVIF_RESULT_OK) {
-        avifImageDestroy(image);
-        avifRGBImageFreePixels(&rgb);
-        avifEncoderDestroy(encoder);
-        return 0;
-    }
+        avifRWData attempt = AVIF_DATA_EMPTY;
+        if(result == AVIF_RESULT_OK) {
+            result = avifEncoderFinish(encoder, &attempt);
+        }
 
-    result = avifEncoderFinish(encoder, &output);
-    if(result != AVIF_RESULT_OK) {
-        avifImageDestroy(image);
-        avifRGBImageFreePixels(&rgb);
+        total_ns += now_ns() - start;
+
+        if(result != AVIF_RESULT_OK) {
+            memcpy(diag, encoder->diag.error, AVIF_DIAGNOSTICS_ERROR_BUFFER_SIZE);
+            avifRWDataFree(&output);
+            avifImageDestroy(image);
+            avifEncoderDestroy(encoder);
+            return 0;
+        }
+
+        avifIOStats attempt_stats = encoder->ioStats;
         avifEncoderDestroy(encoder);
-        return 0;
-    }
+        converted = count == 1;
 
-    *size = output.size;
+        if(target_size == 0) {
+            output = attempt;
+            io_stats = attempt_stats;
+            break;
+        }
+
+        if(attempt.size <= target_size) {
+            avifRWDataFree(&output);
+            output = attempt;
+            io_stats = attempt_stats;
+            *chosen_quality = attempt_quality;
+            lo = attempt_quality + 1;
+        } else if(attempt_quality == 0) {
+            // Nothing fits, keep the smallest output so the caller can report its size.
+            output = attempt;
+            io_stats = attempt_stats;
+            break;
+        } else {
+            avifRWDataFree(&attempt);
+            hi = attempt_quality - 1;
+        }
+    }
 
     avifImageDestroy(image);
-    avifRGBImageFreePixels(&rgb);
-    avifEncoderDestroy(encoder);
+
+    set_stats(stats, io_stats, convert_ns, total_ns - convert_ns);
+
+    *size = output.size;
 
     return output.data;
 }
@@ -0,0 +1,131 @@
+package avif
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+)
+
+// CICP is a color description (ITU-T H.273 code points) stored in the nclx colr box.
+type CICP struct {
+	// ColorPrimaries, e.g. ColorPrimariesBT709.
+	ColorPrimaries int
+	// TransferCharacteristics, e.g. TransferCharacteristicsSRGB.
+	TransferCharacteristics int
+	// MatrixCoefficients, e.g. MatrixCoefficientsBT601.
+	MatrixCoefficients int
+	// FullRange selects full instead of limited (video) range for the Y'CbCr samples.
+	FullRange bool
+}
+
+// Common CICP code points.
+const (
+	ColorPrimariesBT709       = 1
+	ColorPrimariesUnspecified = 2
+	ColorPrimariesBT601       = 6
+	ColorPrimariesBT2020      = 9
+	ColorPrimariesDisplayP3   = 12
+
+	TransferCharacteristicsBT709       = 1
+	TransferCharacteristicsUnspecified = 2
+	TransferCharacteristicsBT601       = 6
+	TransferCharacteristicsLinear      = 8
+	TransferCharacteristicsSRGB        = 13
+	TransferCharacteristicsPQ          = 16
+	TransferCharacteristicsHLG         = 18
+
+	MatrixCoefficientsIdentity    = 0
+	MatrixCoefficientsBT709       = 1
+	MatrixCoefficientsUnspecified = 2
+	MatrixCoefficientsBT601       = 6
+	MatrixCoefficientsYCgCo       = 8
+	MatrixCoefficientsBT2020NCL   = 9
+)
+
+// Metadata holds the properties of the primary item that a re-encode can carry over.
+type Metadata struct {
+	// Color is the nclx color description, nil when the image has none.
+	Color *CICP
+	// ICC is the ICC profile from the colr box, nil when the image has none.
+	ICC []byte
+	// Orientation is the EXIF orientation (1-8) equivalent to the irot/imir properties.
+	Orientation int
+	// MaxCLL and MaxPALL are the content light levels from the clli box in cd/m², 0 when absent.
+	MaxCLL, MaxPALL int
+	// Crop is the clean aperture (clap) window in stored image coordinates, empty when the image has none.
+	Crop image.Rectangle
+	// PixelAspect is the pixel aspect ratio (pasp) as horizontal/vertical spacing, zero when the image has none.
+	PixelAspect Fraction
+}
+
+// DecodeMetadata reads the color description, ICC profile, orientation and light levels of a AVIF image without decoding it.
+func DecodeMetadata(r io.Reader) (*Metadata, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("avif: read: %w", err)
+	}
+
+	props, ok := parseAVIFProps(data)
+	if !ok {
+		return nil, ErrDecode
+	}
+
+	return &Metadata{
+		Color:       props.color,
+		ICC:         props.icc,
+		Orientation: props.orientation,
+		MaxCLL:      props.maxCLL,
+		MaxPALL:     props.maxPALL,
+		Crop:        props.crop,
+		PixelAspect: props.pixelAspect,
+	}, nil
+}
+
+// parseColr fills the color description or ICC profile from a colr property.
+func (p *avifProps) parseColr(colr []byte) {
+	if len(colr) < 4 {
+		return
+	}
+
+	switch string(colr[:4]) {
+	case "nclx":
+		if len(colr) >= 11 {
+			p.color = &CICP{
+				ColorPrimaries:          int(colr[4])<<8 | int(colr[5]),
+				TransferCharacteristics: int(colr[6])<<8 | int(colr[7]),
+				MatrixCoefficients:      int(colr[8])<<8 | int(colr[9]),
+				FullRange:               colr[10]&0x80 != 0,
+			}
+		}
+	case "prof", "rICC":
+		p.icc = bytes.Clone(colr[4:])
+	}
+}
+
+// colorDescription returns the CICP values the encoder writes for in, the avifImageCreate defaults without
+// o.Color. Y'CbCr and Gray sources are always BT.601 full range and lossless RGB uses the identity matrix,
+// so only the primaries and transfer characteristics of o.Color apply to them.
+func colorDescription(in encodeInput, o Options) CICP {
+	c := CICP{
+		ColorPrimaries:          ColorPrimariesUnspecified,
+		TransferCharacteristics: TransferCharacteristicsUnspecified,
+		MatrixCoefficients:      MatrixCoefficientsBT601,
+		FullRange:               true,
+	}
+
+	if o.Color != nil {
+		c = *o.Color
+	}
+
+	switch {
+	case in.yuv:
+		c.MatrixCoefficients = MatrixCoefficientsBT601
+		c.FullRange = true
+	case o.Lossless:
+		c.MatrixCoefficients = MatrixCoefficientsIdentity
+		c.FullRange = true
+	}
+
+	return c
+}
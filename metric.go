@@ -0,0 +1,105 @@
+package avif
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// ssimWindow is the size of the SSIM windows, moved by half a window in each direction.
+const ssimWindow = 8
+
+// SSIM constants for samples in [0,1], (0.01)² and (0.03)².
+const (
+	ssimC1 = 0.0001
+	ssimC2 = 0.0009
+)
+
+// metricPlanes holds the premultiplied R, G, B and A samples of an image in [0,1], and the luma computed from them.
+type metricPlanes struct {
+	width, height int
+	rgba          [4][]float64
+	luma          []float64
+}
+
+func newMetricPlanes(m image.Image) *metricPlanes {
+	b := m.Bounds()
+	p := &metricPlanes{width: b.Dx(), height: b.Dy()}
+
+	n := p.width * p.height
+	for i := range p.rgba {
+		p.rgba[i] = make([]float64, n)
+	}
+	p.luma = make([]float64, n)
+
+	i := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBA64Model.Convert(m.At(x, y)).(color.RGBA64)
+
+			r, g, b := float64(c.R)/0xffff, float64(c.G)/0xffff, float64(c.B)/0xffff
+			p.rgba[0][i], p.rgba[1][i], p.rgba[2][i], p.rgba[3][i] = r, g, b, float64(c.A)/0xffff
+			p.luma[i] = 0.299*r + 0.587*g + 0.114*b
+			i++
+		}
+	}
+
+	return p
+}
+
+// psnr returns the peak signal-to-noise ratio in dB over the R, G, B and A samples, +Inf for identical images.
+func (p *metricPlanes) psnr(q *metricPlanes) float64 {
+	var sum float64
+	for c := range p.rgba {
+		for i, v := range p.rgba[c] {
+			d := v - q.rgba[c][i]
+			sum += d * d
+		}
+	}
+
+	mse := sum / float64(4*len(p.luma))
+	if mse == 0 {
+		return math.Inf(1)
+	}
+
+	return -10 * math.Log10(mse)
+}
+
+// ssim returns the mean structural similarity of the luma over 8x8 windows, 1 for identical images.
+// Images smaller than a window are compared as a whole.
+func (p *metricPlanes) ssim(q *metricPlanes) float64 {
+	ww, wh := min(ssimWindow, p.width), min(ssimWindow, p.height)
+
+	var sum float64
+	var count int
+
+	for y := 0; y+wh <= p.height; y += ssimWindow / 2 {
+		for x := 0; x+ww <= p.width; x += ssimWindow / 2 {
+			sum += p.windowSSIM(q, x, y, ww, wh)
+			count++
+		}
+	}
+
+	return sum / float64(count)
+}
+
+func (p *metricPlanes) windowSSIM(q *metricPlanes, x0, y0, ww, wh int) float64 {
+	var sa, sb, saa, sbb, sab float64
+	for y := y0; y < y0+wh; y++ {
+		for x := x0; x < x0+ww; x++ {
+			a, b := p.luma[y*p.width+x], q.luma[y*q.width+x]
+			sa += a
+			sb += b
+			saa += a * a
+			sbb += b * b
+			sab += a * b
+		}
+	}
+
+	n := float64(ww * wh)
+	ma, mb := sa/n, sb/n
+	va, vb := saa/n-ma*ma, sbb/n-mb*mb
+	cov := sab/n - ma*mb
+
+	return ((2*ma*mb + ssimC1) * (2*cov + ssimC2)) / ((ma*ma + mb*mb + ssimC1) * (va + vb + ssimC2))
+}
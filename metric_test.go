@@ -0,0 +1,101 @@
+package avif
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestMetric(t *testing.T) {
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := newMetricPlanes(img)
+	if s := p.ssim(p); math.Abs(s-1) > 1e-9 {
+		t.Errorf("ssim: got %f for identical images, want 1", s)
+	}
+
+	if v := p.psnr(p); !math.IsInf(v, 1) {
+		t.Errorf("psnr: got %f for identical images, want +Inf", v)
+	}
+
+	noisy := image.NewNRGBA(img.Bounds())
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if (x+y)%2 == 0 {
+				c.R, c.G, c.B = c.R/2, c.G/2, c.B/2
+			}
+			noisy.SetNRGBA(x, y, c)
+		}
+	}
+
+	q := newMetricPlanes(noisy)
+	if s := p.ssim(q); s >= 0.95 || s <= 0 {
+		t.Errorf("ssim: got %f for a noisy image", s)
+	}
+
+	if v := p.psnr(q); v >= 30 || v <= 0 {
+		t.Errorf("psnr: got %f for a noisy image", v)
+	}
+
+	small := newMetricPlanes(image.NewGray(image.Rect(0, 0, 3, 5)))
+	if s := small.ssim(small); math.Abs(s-1) > 1e-9 {
+		t.Errorf("ssim: got %f for a 3x5 image, want 1", s)
+	}
+}
+
+func TestEncodeTargetQuality(t *testing.T) {
+	skipLegacy(t)
+
+	img, err := Decode(bytes.NewReader(testAvif8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var low, high bytes.Buffer
+	err = Encode(&low, img, Options{TargetSSIM: 0.9})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Encode(&high, img, Options{TargetSSIM: 0.98, TargetPSNR: 35})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if low.Len() >= high.Len() {
+		t.Errorf("got %d bytes for SSIM 0.9 and %d for SSIM 0.98, want fewer", low.Len(), high.Len())
+	}
+
+	dec, err := Decode(bytes.NewReader(high.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, q := newMetricPlanes(img), newMetricPlanes(dec)
+	if s := p.ssim(q); s < 0.98 {
+		t.Errorf("ssim: got %f, want at least 0.98", s)
+	}
+
+	if v := p.psnr(q); v < 35 {
+		t.Errorf("psnr: got %f, want at least 35", v)
+	}
+
+	if err := Encode(&low, img, Options{TargetSSIM: 1.5}); err == nil {
+		t.Error("expected error for SSIM over 1")
+	}
+
+	var grid bytes.Buffer
+	err = Encode(&grid, testWide(), Options{TargetPSNR: 30, Speed: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testPaddedGrid(t, grid.Bytes())
+}
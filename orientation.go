@@ -44,6 +44,29 @@ func exifOrientationFromIrotImir(haveRot bool, angle int, haveMir bool, axis int
 	return 1
 }
 
+// irotImirFromExifOrientation is the inverse of exifOrientationFromIrotImir, returning the
+// transform flags, irot angle and imir axis for an EXIF orientation (per libavif avifexif.c).
+func irotImirFromExifOrientation(orientation int) (flags, angle, axis int) {
+	switch orientation {
+	case 2:
+		return avifTransformImir, 0, 1
+	case 3:
+		return avifTransformIrot, 2, 0
+	case 4:
+		return avifTransformImir, 0, 0
+	case 5:
+		return avifTransformIrot | avifTransformImir, 1, 0
+	case 6:
+		return avifTransformIrot, 3, 0
+	case 7:
+		return avifTransformIrot | avifTransformImir, 3, 0
+	case 8:
+		return avifTransformIrot, 1, 0
+	default:
+		return 0, 0, 0
+	}
+}
+
 // applyOrientation returns img rotated/flipped per the EXIF orientation; unchanged for 1 or an unhandled type.
 func applyOrientation(img image.Image, orientation int) image.Image {
 	if orientation <= 1 || orientation > 8 {
@@ -52,16 +75,30 @@ func applyOrientation(img image.Image, orientation int) image.Image {
 
 	switch src := img.(type) {
 	case *image.RGBA:
-		return orientPix(src.Pix, src.Stride, src.Rect, orientation, 4)
+		pix, stride, rect := orientPix(src.Pix, src.Stride, src.Rect, orientation, 4)
+		return &image.RGBA{Pix: pix, Stride: stride, Rect: rect}
 	case *image.RGBA64:
-		return orientPix(src.Pix, src.Stride, src.Rect, orientation, 8)
+		pix, stride, rect := orientPix(src.Pix, src.Stride, src.Rect, orientation, 8)
+		return &image.RGBA64{Pix: pix, Stride: stride, Rect: rect}
+	case *image.NRGBA:
+		pix, stride, rect := orientPix(src.Pix, src.Stride, src.Rect, orientation, 4)
+		return &image.NRGBA{Pix: pix, Stride: stride, Rect: rect}
+	case *image.NRGBA64:
+		pix, stride, rect := orientPix(src.Pix, src.Stride, src.Rect, orientation, 8)
+		return &image.NRGBA64{Pix: pix, Stride: stride, Rect: rect}
+	case *image.Gray:
+		pix, stride, rect := orientPix(src.Pix, src.Stride, src.Rect, orientation, 1)
+		return &image.Gray{Pix: pix, Stride: stride, Rect: rect}
+	case *image.Gray16:
+		pix, stride, rect := orientPix(src.Pix, src.Stride, src.Rect, orientation, 2)
+		return &image.Gray16{Pix: pix, Stride: stride, Rect: rect}
 	default:
 		return img
 	}
 }
 
-// orientPix builds a reoriented image by copying pixels of the given byte width.
-func orientPix(pix []byte, stride int, r image.Rectangle, o, bpp int) image.Image {
+// orientPix reorients pixels of the given byte width, returning the new pixels, stride and bounds.
+func orientPix(pix []byte, stride int, r image.Rectangle, o, bpp int) ([]byte, int, image.Rectangle) {
 	sw, sh := r.Dx(), r.Dy()
 	dw, dh := sw, sh
 	if o >= 5 {
@@ -98,10 +135,5 @@ func orientPix(pix []byte, stride int, r image.Rectangle, o, bpp int) image.Imag
 		}
 	}
 
-	rect := image.Rect(0, 0, dw, dh)
-	if bpp == 8 {
-		return &image.RGBA64{Pix: dst, Stride: dstStride, Rect: rect}
-	}
-
-	return &image.RGBA{Pix: dst, Stride: dstStride, Rect: rect}
+	return dst, dstStride, image.Rect(0, 0, dw, dh)
 }
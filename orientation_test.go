@@ -134,3 +134,64 @@ func TestOrientDims(t *testing.T) {
 		}
 	}
 }
+
+func TestIrotImirFromExifOrientation(t *testing.T) {
+	for o := 1; o <= 8; o++ {
+		flags, angle, axis := irotImirFromExifOrientation(o)
+		got := exifOrientationFromIrotImir(flags&avifTransformIrot != 0, angle, flags&avifTransformImir != 0, axis)
+		if got != o {
+			t.Errorf("orientation %d: round trip got %d", o, got)
+		}
+	}
+}
+
+func TestEncodeOrientation(t *testing.T) {
+	skipLegacy(t)
+
+	img := image.NewRGBA(image.Rect(0, 0, 32, 16))
+
+	for o := 1; o <= 8; o++ {
+		var b bytes.Buffer
+		err := encode(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Orientation: o}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testOrientation(t, b.Bytes(), o)
+	}
+}
+
+func TestEncodeOrientationDynamic(t *testing.T) {
+	if err := Dynamic(); err != nil {
+		t.Skip()
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 32, 16))
+
+	for o := 1; o <= 8; o++ {
+		var b bytes.Buffer
+		err := encodeDynamic(&b, []image.Image{img}, []uint64{1}, encodeOptions([]Options{{Orientation: o}}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testOrientation(t, b.Bytes(), o)
+	}
+}
+
+func testOrientation(t *testing.T, data []byte, want int) {
+	t.Helper()
+
+	p, ok := parseAVIFProps(data)
+	if !ok {
+		t.Fatal("no properties parsed")
+	}
+
+	if p.orientation != want {
+		t.Errorf("orientation: got %d, want %d", p.orientation, want)
+	}
+
+	if p.width != 32 || p.height != 16 {
+		t.Errorf("stored dims: got %dx%d, want 32x16", p.width, p.height)
+	}
+}
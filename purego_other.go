@@ -13,14 +13,22 @@ var (
 	dynamicErr = fmt.Errorf("avif: dynamic disabled")
 )
 
-func decodeDynamic(r io.Reader, configOnly, decodeAll bool) (*AVIF, image.Config, error) {
+func decodeDynamic(r io.Reader, configOnly, decodeAll bool, o Options) (*AVIF, image.Config, error) {
 	return nil, image.Config{}, dynamicErr
 }
 
-func encodeDynamic(w io.Writer, m image.Image, quality, qualityAlpha, speed int, subsampleRatio image.YCbCrSubsampleRatio, lossless bool) error {
+func encodeDynamic(w io.Writer, images []image.Image, durations []uint64, o Options) error {
 	return dynamicErr
 }
 
+func encodeDynamicToSize(w io.Writer, images []image.Image, durations []uint64, o Options, maxBytes int) (int, error) {
+	return 0, dynamicErr
+}
+
 func loadLibrary() (uintptr, error) {
 	return 0, dynamicErr
 }
+
+func checkDynamicCodec(codec int, flag uint32) error {
+	return dynamicErr
+}